@@ -0,0 +1,284 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	errNoToken      = errors.New("missing bearer token")
+	errUnknownToken = errors.New("unknown or revoked token")
+)
+
+// AuthToken is a token allowed to push reports, optionally only for some
+// homeservers.
+type AuthToken struct {
+	Name        string   `json:"name"`
+	Token       string   `json:"token"`
+	Homeservers []string `json:"homeservers"` // normalized names; empty for any homeserver
+}
+
+// allows reports whether the token may push reports for a homeserver.
+func (t *AuthToken) allows(homeserver string) bool {
+	if len(t.Homeservers) == 0 {
+		return true
+	}
+	for _, hs := range t.Homeservers {
+		if hs == homeserver {
+			return true
+		}
+	}
+	return false
+}
+
+func createTableAuthTokens(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS auth_tokens(
+		name VARCHAR(128) NOT NULL PRIMARY KEY,
+		token_hash VARCHAR(64) NOT NULL,
+		homeservers TEXT,
+		created_at BIGINT,
+		revoked_at BIGINT
+		)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS auth_token_usage(
+		name VARCHAR(128) NOT NULL PRIMARY KEY,
+		use_count BIGINT,
+		last_used BIGINT,
+		last_homeserver VARCHAR(256)
+		)`)
+	return err
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenAuth authenticates pushes by bearer token, with tokens from a file,
+// the auth_tokens table, or both.
+type TokenAuth struct {
+	DB     *sql.DB
+	UseDB  bool
+	tokens map[string]*AuthToken // from the file, by hash
+}
+
+// loadTokenFile reads tokens from a JSON file of the form
+// {"tokens": [{"name": ..., "token": ..., "homeservers": [...]}]}.
+func (a *TokenAuth) loadTokenFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Tokens []*AuthToken `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	a.tokens = make(map[string]*AuthToken)
+	for _, t := range file.Tokens {
+		if t.Name == "" || t.Token == "" {
+			return fmt.Errorf("%s: tokens need a name and a token", path)
+		}
+		if t.Homeservers, err = normalizeServerNames(t.Homeservers); err != nil {
+			return fmt.Errorf("%s: token %s: %w", path, t.Name, err)
+		}
+		a.tokens[hashToken(t.Token)] = t
+	}
+	return nil
+}
+
+func normalizeServerNames(names []string) ([]string, error) {
+	var normalized []string
+	for _, name := range names {
+		n, err := normalizeServerName(name)
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, n)
+	}
+	return normalized, nil
+}
+
+// Authenticate finds the token a request was made with.
+func (a *TokenAuth) Authenticate(req *http.Request) (*AuthToken, error) {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, errNoToken
+	}
+	hash := hashToken(strings.TrimPrefix(header, "Bearer "))
+	if t, ok := a.tokens[hash]; ok {
+		return t, nil
+	}
+	if !a.UseDB {
+		return nil, errUnknownToken
+	}
+
+	t := &AuthToken{}
+	var homeservers sql.NullString
+	err := a.DB.QueryRow(rebind(`SELECT name, homeservers FROM auth_tokens
+		WHERE token_hash = ? AND revoked_at IS NULL`), hash,
+	).Scan(&t.Name, &homeservers)
+	if err == sql.ErrNoRows {
+		return nil, errUnknownToken
+	} else if err != nil {
+		return nil, err
+	}
+	if homeservers.String != "" {
+		t.Homeservers = strings.Split(homeservers.String, ",")
+	}
+	return t, nil
+}
+
+// RecordUse counts a report pushed with a token.
+func (a *TokenAuth) RecordUse(t *AuthToken, homeserver string, timestamp int64) error {
+	_, err := a.DB.Exec(rebind(`INSERT INTO auth_token_usage
+		(name, use_count, last_used, last_homeserver) VALUES (?, 1, ?, ?)`+
+		onConflict("name", "use_count = use_count + 1, last_used = excluded.last_used, last_homeserver = excluded.last_homeserver")),
+		t.Name, timestamp, homeserver,
+	)
+	return err
+}
+
+// tokensCommand implements "panopticon tokens create|revoke|list", which
+// manage the tokens in the auth_tokens table.
+func tokensCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: panopticon tokens create|revoke|list [flags]")
+	}
+	if err := loadConfig(configPath()); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	fs := flag.NewFlagSet("tokens "+args[0], flag.ExitOnError)
+	fs.StringVar(dbDriver, "db-driver", *dbDriver, "the database driver to use")
+	fs.StringVar(dbPath, "db", *dbPath, "the data source to use, for sqlite this is the path to the file")
+	fs.StringVar(tenantsConfig, "tenants-config", *tenantsConfig, "the JSON file listing tenants")
+	tenant := fs.String("tenant", "", "only manage the tokens the tenant lists in its tokens")
+	name := fs.String("name", "", "the name of the token")
+	homeservers := fs.String("homeservers", "", "comma-separated homeservers the token may push reports for, empty for any")
+	fs.Parse(args[1:])
+
+	// Tokens are kept in the default database whichever tenant they are for,
+	// as they are checked before the tenant of a report is known.
+	var tenantTokens map[string]bool
+	if *tenant != "" {
+		tc, err := tenantConfig(*tenantsConfig, *tenant)
+		if err != nil {
+			log.Fatalf("Invalid --tenant: %v", err)
+		}
+		tenantTokens = map[string]bool{}
+		for _, t := range tc.Tokens {
+			tenantTokens[t] = true
+		}
+		if args[0] != "list" && !tenantTokens[*name] {
+			log.Fatalf("Tenant %s does not list a token %q in its tokens", *tenant, *name)
+		}
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close()
+	if err := createTableAuthTokens(db); err != nil {
+		log.Fatalf("Error creating database: %v", err)
+	}
+
+	switch args[0] {
+	case "create":
+		if *name == "" {
+			log.Fatalf("tokens create needs a --name")
+		}
+		var bound []string
+		if *homeservers != "" {
+			if bound, err = normalizeServerNames(strings.Split(*homeservers, ",")); err != nil {
+				log.Fatalf("Invalid --homeservers: %v", err)
+			}
+		}
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Error generating token: %v", err)
+		}
+		token := hex.EncodeToString(secret)
+		if _, err := db.Exec(rebind(`INSERT INTO auth_tokens (name, token_hash, homeservers, created_at)
+			VALUES (?, ?, ?, ?)`), *name, hashToken(token), strings.Join(bound, ","), time.Now().Unix(),
+		); err != nil {
+			log.Fatalf("Error creating token: %v", err)
+		}
+		fmt.Println(token)
+	case "revoke":
+		res, err := db.Exec(rebind(`UPDATE auth_tokens SET revoked_at = ? WHERE name = ? AND revoked_at IS NULL`),
+			time.Now().Unix(), *name,
+		)
+		if err != nil {
+			log.Fatalf("Error revoking token: %v", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			log.Fatalf("No token %q to revoke", *name)
+		}
+	case "list":
+		rows, err := db.Query(`SELECT t.name, t.homeservers, t.created_at, t.revoked_at, u.use_count, u.last_used
+			FROM auth_tokens t LEFT JOIN auth_token_usage u ON u.name = t.name ORDER BY t.name`)
+		if err != nil {
+			log.Fatalf("Error listing tokens: %v", err)
+		}
+		defer rows.Close()
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tHOMESERVERS\tCREATED\tREVOKED\tUSES\tLAST USED")
+		for rows.Next() {
+			var name string
+			var homeservers sql.NullString
+			var created, revoked, uses, lastUsed sql.NullInt64
+			if err := rows.Scan(&name, &homeservers, &created, &revoked, &uses, &lastUsed); err != nil {
+				log.Fatalf("Error listing tokens: %v", err)
+			}
+			if tenantTokens != nil && !tenantTokens[name] {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", name, homeservers.String,
+				formatUnix(created), formatUnix(revoked), uses.Int64, formatUnix(lastUsed))
+		}
+		if err := rows.Err(); err != nil {
+			log.Fatalf("Error listing tokens: %v", err)
+		}
+		w.Flush()
+	default:
+		log.Fatalf("Unknown tokens command %q: expected create, revoke or list", args[0])
+	}
+}
+
+func formatUnix(t sql.NullInt64) string {
+	if !t.Valid {
+		return "-"
+	}
+	return time.Unix(t.Int64, 0).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,42 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Values of CommonStats.TimestampFlag
+const (
+	TimestampFuture = "future"
+	TimestampPast   = "past"
+)
+
+// checkClockSkew compares the timestamp claimed by the homeserver with the
+// time we received the report, and flags the report if the difference is
+// beyond --max-future-skew or --max-past-skew.
+func (c *CommonStats) checkClockSkew() {
+	c.ClockSkewSeconds = nil
+	c.TimestampFlag = ""
+	if c.RemoteTimestamp == nil {
+		return
+	}
+
+	skew := c.LocalTimestamp - *c.RemoteTimestamp
+	c.ClockSkewSeconds = &skew
+	clockSkew.Observe(float64(skew))
+
+	if -skew > int64(maxFutureSkew.Seconds()) {
+		c.TimestampFlag = TimestampFuture
+	} else if skew > int64(maxPastSkew.Seconds()) {
+		c.TimestampFlag = TimestampPast
+	}
+}
@@ -0,0 +1,497 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-sql-driver/mysql"
+)
+
+// aggregationFlags holds the settings of the aggregation script, so that they
+// can be validated and printed along with those of panopticon itself.
+var aggregationFlags = flag.NewFlagSet("aggregation", flag.ContinueOnError)
+
+var (
+	churnDays                = aggregationFlags.Int("churn-days", 30, "number of days without a report after which a homeserver is counted as churned")
+	recomputeDays            = aggregationFlags.Int("recompute-days", 2, "number of already aggregated days to aggregate again on each run")
+	carryForwardDays         = aggregationFlags.Int("carry-forward-days", 0, "number of days to carry the latest report of a homeserver forward over missed days")
+	anomalyMaxPercentChange  = aggregationFlags.Float64("anomaly-max-percent-change", 30, "alert when a daily aggregate differs from the median of the previous week by more than this percentage")
+	anomalyMaxZScore         = aggregationFlags.Float64("anomaly-max-zscore", 4, "alert when a daily aggregate is more than this many standard deviations from the mean of the previous week")
+	breakdownDimensions      = aggregationFlags.String("breakdown-dimensions", strings.Join(aggregationDimensions, ","), "comma-separated dimensions to break the daily aggregates down by")
+	alertWebhooks            = aggregationFlags.String("alert-webhooks", "", "comma-separated URLs to POST alerts to")
+	aggregationTimezone      = aggregationFlags.String("timezone", "UTC", "the time zone in which days, weeks and months start")
+	rollups                  = aggregationFlags.String("rollups", "", "comma-separated granularities to roll the stats up by: hour, week and month")
+	minTrustScore            = aggregationFlags.Float64("min-trust-score", 0, "leave reports with a lower trust score out of the aggregates")
+	excludeOwnershipMismatch = aggregationFlags.Bool("exclude-ownership-mismatch", false, "leave homeservers which failed the ownership check out of the aggregates")
+	aggregationDimensions    = []string{"database_engine", "server_software", "python_version", "go_version", "goos", "goarch", "monolith", "nats_embedded", "log_level"}
+	aggregationRollupPeriods = []string{"hour", "week", "month"}
+)
+
+// A configSetting maps a key of the config file to a flag. The flag can also
+// be set by the environment variable named after it, such as
+// PANOPTICON_DB_DRIVER for --db-driver.
+type configSetting struct {
+	Section string
+	Key     string
+	Flags   *flag.FlagSet
+	Flag    string
+	Redact  func(string) string // nil if the value is not secret
+
+	// Reloadable settings are applied again when panopticon reloads its
+	// configuration, rather than only when it starts.
+	Reloadable bool
+}
+
+func (s configSetting) env() string {
+	return "PANOPTICON_" + strings.ToUpper(strings.ReplaceAll(s.Flag, "-", "_"))
+}
+
+var configSections = []string{"listeners", "storage", "ingestion", "aggregation", "retention", "privacy", "sinks", "logging"}
+
+var configSettings = []configSetting{
+	{Section: "listeners", Key: "port", Flag: "port"},
+	{Section: "listeners", Key: "tls_cert", Flag: "tls-cert"},
+	{Section: "listeners", Key: "tls_key", Flag: "tls-key"},
+	{Section: "listeners", Key: "tls_client_ca", Flag: "tls-client-ca"},
+	{Section: "listeners", Key: "tls_reload_interval", Flag: "tls-reload-interval"},
+	{Section: "listeners", Key: "auth_tokens_file", Flag: "auth-tokens-file"},
+	{Section: "listeners", Key: "auth_tokens_db", Flag: "auth-tokens-db"},
+	{Section: "listeners", Key: "enable_export", Flag: "enable-export"},
+	{Section: "listeners", Key: "read_timeout", Flag: "read-timeout"},
+	{Section: "listeners", Key: "write_timeout", Flag: "write-timeout"},
+	{Section: "listeners", Key: "idle_timeout", Flag: "idle-timeout"},
+	{Section: "listeners", Key: "admin_listen", Flag: "admin-listen"},
+	{Section: "listeners", Key: "admin_token", Flag: "admin-token", Redact: redactAll},
+	{Section: "listeners", Key: "admin_read_timeout", Flag: "admin-read-timeout"},
+	{Section: "listeners", Key: "admin_write_timeout", Flag: "admin-write-timeout"},
+	{Section: "listeners", Key: "admin_idle_timeout", Flag: "admin-idle-timeout"},
+
+	{Section: "storage", Key: "driver", Flag: "db-driver"},
+	{Section: "storage", Key: "db", Flag: "db", Redact: redactDSN},
+	{Section: "storage", Key: "host", Flag: "db-host"},
+	{Section: "storage", Key: "port", Flag: "db-port"},
+	{Section: "storage", Key: "name", Flag: "db-name"},
+	{Section: "storage", Key: "user", Flag: "db-user"},
+	{Section: "storage", Key: "password", Flag: "db-password", Redact: redactAll},
+	{Section: "storage", Key: "tenants_config", Flag: "tenants-config"},
+
+	{Section: "ingestion", Key: "max_past_skew", Flag: "max-past-skew"},
+	{Section: "ingestion", Key: "max_future_skew", Flag: "max-future-skew"},
+	{Section: "ingestion", Key: "suspicious_timestamps", Flag: "suspicious-timestamps"},
+	{Section: "ingestion", Key: "rules_config", Flag: "rules-config", Reloadable: true},
+	{Section: "ingestion", Key: "rules_reload_interval", Flag: "rules-reload-interval"},
+	{Section: "ingestion", Key: "trust_history", Flag: "trust-history"},
+	{Section: "ingestion", Key: "trust_min_reports", Flag: "trust-min-reports"},
+	{Section: "ingestion", Key: "trusted_proxies", Flag: "trusted-proxies"},
+	{Section: "ingestion", Key: "verify_signatures", Flag: "verify-signatures"},
+	{Section: "ingestion", Key: "key_server_url", Flag: "key-server-url"},
+	{Section: "ingestion", Key: "allow_private_targets", Flag: "allow-private-targets"},
+	{Section: "ingestion", Key: "wellknown_check_interval", Flag: "wellknown-check-interval"},
+	{Section: "ingestion", Key: "wellknown_url", Flag: "wellknown-url"},
+	{Section: "ingestion", Key: "wellknown_max_age", Flag: "wellknown-max-age"},
+	{Section: "ingestion", Key: "watch_config", Flag: "watch-config", Reloadable: true},
+	{Section: "ingestion", Key: "rate_limit", Flag: "rate-limit", Reloadable: true},
+	{Section: "ingestion", Key: "rate_limit_period", Flag: "rate-limit-period", Reloadable: true},
+
+	{Section: "aggregation", Key: "churn_days", Flags: aggregationFlags, Flag: "churn-days"},
+	{Section: "aggregation", Key: "recompute_days", Flags: aggregationFlags, Flag: "recompute-days"},
+	{Section: "aggregation", Key: "carry_forward_days", Flags: aggregationFlags, Flag: "carry-forward-days"},
+	{Section: "aggregation", Key: "anomaly_max_percent_change", Flags: aggregationFlags, Flag: "anomaly-max-percent-change"},
+	{Section: "aggregation", Key: "anomaly_max_zscore", Flags: aggregationFlags, Flag: "anomaly-max-zscore"},
+	{Section: "aggregation", Key: "breakdown_dimensions", Flags: aggregationFlags, Flag: "breakdown-dimensions"},
+	{Section: "aggregation", Key: "alert_webhooks", Flags: aggregationFlags, Flag: "alert-webhooks", Redact: redactURLs},
+	{Section: "aggregation", Key: "timezone", Flags: aggregationFlags, Flag: "timezone"},
+	{Section: "aggregation", Key: "rollups", Flags: aggregationFlags, Flag: "rollups"},
+	{Section: "aggregation", Key: "min_trust_score", Flags: aggregationFlags, Flag: "min-trust-score"},
+	{Section: "aggregation", Key: "exclude_ownership_mismatch", Flags: aggregationFlags, Flag: "exclude-ownership-mismatch"},
+
+	{Section: "retention", Key: "reports", Flag: "retain-reports"},
+	{Section: "retention", Key: "events", Flag: "retain-events"},
+	{Section: "retention", Key: "interval", Flag: "retention-interval"},
+
+	{Section: "privacy", Key: "store_addresses", Flag: "store-addresses"},
+
+	{Section: "logging", Key: "level", Flag: "log-level", Reloadable: true},
+
+	{Section: "sinks", Key: "webhooks", Flag: "sink-webhooks", Redact: redactURLs, Reloadable: true},
+	{Section: "sinks", Key: "nats_url", Flag: "sink-nats-url", Redact: redactURLs, Reloadable: true},
+	{Section: "sinks", Key: "nats_subject", Flag: "sink-nats-subject", Reloadable: true},
+	{Section: "sinks", Key: "nats_embedded_port", Flag: "sink-nats-embedded-port"},
+	{Section: "sinks", Key: "max_retries", Flag: "sink-max-retries", Reloadable: true},
+	{Section: "sinks", Key: "otlp_endpoint", Flag: "otlp-endpoint", Redact: redactURLs},
+	{Section: "sinks", Key: "otlp_batch_size", Flag: "otlp-batch-size"},
+	{Section: "sinks", Key: "otlp_batch_interval", Flag: "otlp-batch-interval"},
+	{Section: "sinks", Key: "otlp_max_retries", Flag: "otlp-max-retries"},
+}
+
+func (s configSetting) flags() *flag.FlagSet {
+	if s.Flags != nil {
+		return s.Flags
+	}
+	return flag.CommandLine
+}
+
+// configPath returns the config file given with --config, or in
+// PANOPTICON_CONFIG.
+func configPath() string {
+	if *configFile != "" {
+		return *configFile
+	}
+	return os.Getenv("PANOPTICON_CONFIG")
+}
+
+// commandLineFlags are the flags given on the command line, which the config
+// file and environment variables do not override.
+var commandLineFlags map[string]bool
+
+// loadConfig sets the flags which were not given on the command line from
+// their environment variables, if not empty, or failing that from the config
+// file at path, if any. It then checks that the resulting configuration makes
+// sense.
+func loadConfig(path string) error {
+	if commandLineFlags == nil {
+		commandLineFlags = map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { commandLineFlags[f.Name] = true })
+	}
+	if err := applyConfig(path, configSettings); err != nil {
+		return err
+	}
+	if *dbDriver == "mysql" && *dbName != "" && !isFlagSet(flag.CommandLine, "db") {
+		cfg := mysql.NewConfig()
+		cfg.User = *dbUser
+		cfg.Passwd = *dbPassword
+		cfg.Net = "tcp"
+		cfg.Addr = fmt.Sprintf("%s:%d", *dbHost, *dbPort)
+		cfg.DBName = *dbName
+		flag.Set("db", cfg.FormatDSN())
+	}
+	return validateConfig()
+}
+
+// reloadConfig applies the config file and environment variables to the
+// reloadable settings again, and validates the result. If it is invalid, the
+// settings are left as they were.
+func reloadConfig(path string) (restore func(), err error) {
+	var settings []configSetting
+	previous := map[string]string{}
+	for _, s := range configSettings {
+		if s.Reloadable {
+			settings = append(settings, s)
+			previous[s.Flag] = s.flags().Lookup(s.Flag).Value.String()
+		}
+	}
+	restore = func() {
+		for _, s := range settings {
+			s.flags().Set(s.Flag, previous[s.Flag])
+		}
+	}
+	if err = applyConfig(path, settings); err == nil {
+		err = validateConfig()
+	}
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	return restore, nil
+}
+
+// applyConfig sets the given settings from the environment or the config
+// file, and resets those which are set in neither to their defaults.
+func applyConfig(path string, settings []configSetting) error {
+	file := map[string]string{}
+	if path != "" {
+		var err error
+		if file, err = readConfigFile(path); err != nil {
+			return err
+		}
+	}
+	for _, s := range settings {
+		fs := s.flags()
+		if fs == flag.CommandLine && commandLineFlags[s.Flag] {
+			continue
+		}
+		if value := os.Getenv(s.env()); value != "" {
+			if err := fs.Set(s.Flag, value); err != nil {
+				return fmt.Errorf("invalid %s: %v", s.env(), err)
+			}
+		} else if value, ok := file[s.Section+"."+s.Key]; ok {
+			if err := fs.Set(s.Flag, value); err != nil {
+				return fmt.Errorf("invalid %s.%s: %v", s.Section, s.Key, err)
+			}
+		} else if f := fs.Lookup(s.Flag); f.Value.String() != f.DefValue {
+			fs.Set(s.Flag, f.DefValue)
+		}
+	}
+	return nil
+}
+
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// readConfigFile reads a TOML config file into the values of its settings,
+// by "section.key", formatted as their flags expect. Lists are joined with
+// commas.
+func readConfigFile(path string) (map[string]string, error) {
+	var sections map[string]interface{}
+	if _, err := toml.DecodeFile(path, &sections); err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, s := range configSettings {
+		known[s.Section+"."+s.Key] = true
+	}
+	values := map[string]string{}
+	for section, keys := range sections {
+		table, ok := keys.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s is not a section", section)
+		}
+		for key, value := range table {
+			name := section + "." + key
+			if !known[name] {
+				return nil, fmt.Errorf("unknown setting %s", name)
+			}
+			s, err := formatConfigValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			values[name] = s
+		}
+	}
+	return values, nil
+}
+
+func formatConfigValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := formatConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// validateConfig checks the settings which can be wrong in ways their flags
+// do not catch.
+func validateConfig() error {
+	switch *dbDriver {
+	case "sqlite3", "mysql":
+	default:
+		return fmt.Errorf("unknown database driver %q", *dbDriver)
+	}
+	switch *suspiciousTimestampMode {
+	case "accept", "reject", "quarantine":
+	default:
+		return fmt.Errorf("invalid value for suspicious timestamps: %q", *suspiciousTimestampMode)
+	}
+	if _, err := parseLogLevel(*logLevel); err != nil {
+		return err
+	}
+	if *rateLimit < 0 || *rateLimitPeriod <= 0 {
+		return fmt.Errorf("the rate limit must not be negative, and its period must be positive")
+	}
+	if _, err := parseNetworks(*trustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	if *rulesReloadInterval <= 0 {
+		return fmt.Errorf("the rules reload interval must be positive")
+	}
+	if *otlpBatchInterval <= 0 {
+		return fmt.Errorf("the OTLP batch interval must be positive")
+	}
+	if *adminListen != "" && *adminToken == "" && !isLocalAddr(*adminListen) {
+		return fmt.Errorf("an admin listener which is not a Unix socket or on a loopback address needs an admin token")
+	}
+	if *enableExport && *adminListen == "" && *adminToken == "" {
+		return fmt.Errorf("exports need an admin listener or an admin token")
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return fmt.Errorf("a TLS certificate needs a key, and a key a certificate")
+	}
+	if *tlsClientCA != "" && *tlsCert == "" {
+		return fmt.Errorf("a TLS client CA needs a TLS certificate")
+	}
+	if *tlsReloadInterval < 0 {
+		return fmt.Errorf("the TLS reload interval must not be negative")
+	}
+	for _, dimension := range splitList(*breakdownDimensions) {
+		if !contains(aggregationDimensions, dimension) {
+			return fmt.Errorf("unknown breakdown dimension %q", dimension)
+		}
+	}
+	for _, period := range splitList(*rollups) {
+		if !contains(aggregationRollupPeriods, period) {
+			return fmt.Errorf("unknown rollup granularity %q", period)
+		}
+	}
+	if _, err := time.LoadLocation(*aggregationTimezone); err != nil {
+		return fmt.Errorf("unknown time zone %q", *aggregationTimezone)
+	}
+	if *retentionInterval <= 0 {
+		return fmt.Errorf("the retention interval must be positive")
+	}
+	return checkReportRetention(*retainReports)
+}
+
+// checkReportRetention checks that reports are retained for long enough for
+// the aggregation script, which reads back this many days of them.
+func checkReportRetention(retention time.Duration) error {
+	days := *churnDays
+	if d := *recomputeDays + *carryForwardDays + 1; d > days {
+		days = d
+	}
+	if retention > 0 && retention < time.Duration(days)*24*time.Hour {
+		return fmt.Errorf("reports must be retained for at least %d days for the aggregation", days)
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func contains(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// printConfig writes the effective configuration as a config file, with
+// secrets redacted.
+func printConfig(w io.Writer) {
+	for i, section := range configSections {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "[%s]\n", section)
+		for _, s := range configSettings {
+			if s.Section != section {
+				continue
+			}
+			f := s.flags().Lookup(s.Flag)
+			value := f.Value.(flag.Getter).Get()
+			switch v := value.(type) {
+			case bool, int, float64:
+				fmt.Fprintf(w, "%s = %v\n", s.Key, v)
+			default:
+				str := f.Value.String()
+				if s.Redact != nil && str != "" {
+					str = s.Redact(str)
+				}
+				fmt.Fprintf(w, "%s = %q\n", s.Key, str)
+			}
+		}
+	}
+}
+
+func redactAll(string) string {
+	return "xxxxx"
+}
+
+// redactDSN hides the password in a MySQL data source.
+func redactDSN(dsn string) string {
+	if *dbDriver != "mysql" {
+		return dsn
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return redactAll(dsn)
+	}
+	if cfg.Passwd != "" {
+		cfg.Passwd = redactAll(cfg.Passwd)
+	}
+	return cfg.FormatDSN()
+}
+
+// redactURLs hides the passwords and query strings, which often hold tokens,
+// of a comma-separated list of URLs.
+func redactURLs(urls string) string {
+	var redacted []string
+	for _, s := range strings.Split(urls, ",") {
+		u, err := url.Parse(s)
+		if err != nil {
+			redacted = append(redacted, redactAll(s))
+			continue
+		}
+		if u.RawQuery != "" {
+			u.RawQuery = redactAll(u.RawQuery)
+		}
+		redacted = append(redacted, u.Redacted())
+	}
+	return strings.Join(redacted, ",")
+}
+
+func configCommand(args []string) {
+	if len(args) == 0 || (args[0] != "validate" && args[0] != "print") {
+		log.Fatalf("Usage: panopticon config validate|print [--config=FILE]")
+	}
+	fs := flag.NewFlagSet("config "+args[0], flag.ExitOnError)
+	fs.StringVar(configFile, "config", *configFile, "the config file to use, instead of PANOPTICON_CONFIG")
+	fs.Parse(args[1:])
+
+	if err := loadConfig(configPath()); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if args[0] == "print" {
+		printConfig(os.Stdout)
+		return
+	}
+	if *tenantsConfig != "" {
+		if _, err := loadTenantsConfig(*tenantsConfig); err != nil {
+			log.Fatalf("Invalid tenants: %v", err)
+		}
+	}
+	fmt.Println("Configuration is valid")
+}
@@ -1,5 +1,6 @@
 #!/bin/sh
 #
-# Converts environment variables into flags for panopticon
+# panopticon reads its PANOPTICON_* environment variables, and the config file
+# named by PANOPTICON_CONFIG, itself.
 
-exec /root/panopticon --db-driver=$PANOPTICON_DB_DRIVER --db=$PANOPTICON_DB --port=$PANOPTICON_PORT
+exec /root/panopticon "$@"
@@ -0,0 +1,440 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// exportTable describes how to export one of our tables.
+type exportTable struct {
+	timeColumn string // column filtered on by ExportOptions.From and To
+	orderBy    string
+	serverType string            // if set, added to every row as server_type
+	renames    map[string]string // columns whose names differ between server types
+}
+
+var exportTables = map[string]exportTable{
+	"stats": {
+		timeColumn: "local_timestamp",
+		orderBy:    "id",
+		serverType: "synapse",
+	},
+	"dendrite_stats": {
+		timeColumn: "local_timestamp",
+		orderBy:    "id",
+		serverType: "dendrite",
+		renames: map[string]string{
+			"goos":      "go_os",
+			"goarch":    "go_arch",
+			"goversion": "go_version",
+		},
+	},
+	"aggregate_stats": {
+		timeColumn: "day",
+		orderBy:    "day",
+	},
+}
+
+// Formats which tables can be exported as
+const (
+	FormatCSV     = "csv"
+	FormatJSONL   = "jsonl"
+	FormatParquet = "parquet"
+)
+
+// parquetRowGroupSize bounds how much of a parquet export is held in memory
+// before being written out.
+const parquetRowGroupSize = 16 * 1024 * 1024
+
+type ExportOptions struct {
+	Table  string
+	Format string
+	From   int64 // seconds since epoch, inclusive, 0 for no limit
+	To     int64 // seconds since epoch, exclusive, 0 for no limit
+}
+
+func (opts *ExportOptions) validate() error {
+	if _, ok := exportTables[opts.Table]; !ok {
+		return fmt.Errorf("unknown table %q", opts.Table)
+	}
+	switch opts.Format {
+	case FormatCSV, FormatJSONL, FormatParquet:
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", opts.Format)
+}
+
+// exportColumn is a column of an export along with a value to scan it into.
+type exportColumn struct {
+	name  string
+	value interface{} // *sql.NullInt64, *sql.NullFloat64 or *sql.NullString
+}
+
+func newExportColumn(name string, ct *sql.ColumnType) exportColumn {
+	typ := strings.ToUpper(ct.DatabaseTypeName())
+	switch {
+	case strings.Contains(typ, "INT"):
+		return exportColumn{name, &sql.NullInt64{}}
+	case strings.Contains(typ, "DOUBLE"), strings.Contains(typ, "FLOAT"), strings.Contains(typ, "REAL"), strings.Contains(typ, "DECIMAL"):
+		return exportColumn{name, &sql.NullFloat64{}}
+	}
+	return exportColumn{name, &sql.NullString{}}
+}
+
+// get returns the scanned value of the column, or nil if it is NULL.
+func (c *exportColumn) get() interface{} {
+	switch v := c.value.(type) {
+	case *sql.NullInt64:
+		if v.Valid {
+			return v.Int64
+		}
+	case *sql.NullFloat64:
+		if v.Valid {
+			return v.Float64
+		}
+	case *sql.NullString:
+		if v.Valid {
+			return v.String
+		}
+	}
+	return nil
+}
+
+func (c *exportColumn) parquetType() string {
+	switch c.value.(type) {
+	case *sql.NullInt64:
+		return "type=INT64"
+	case *sql.NullFloat64:
+		return "type=DOUBLE"
+	}
+	return "type=BYTE_ARRAY, convertedtype=UTF8"
+}
+
+// rowWriter writes exported rows in one of the export formats.
+type rowWriter interface {
+	WriteRow(row []interface{}) error
+	Close() error
+}
+
+// Export streams the rows of a table to w, one at a time so that the size of
+// the table does not matter.
+func Export(db *sql.DB, w io.Writer, opts ExportOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	table := exportTables[opts.Table]
+
+	qry := "SELECT * FROM " + opts.Table + " WHERE 1=1"
+	var args []interface{}
+	if opts.From != 0 {
+		qry += " AND " + table.timeColumn + " >= ?"
+		args = append(args, opts.From)
+	}
+	if opts.To != 0 {
+		qry += " AND " + table.timeColumn + " < ?"
+		args = append(args, opts.To)
+	}
+	qry += " ORDER BY " + table.orderBy
+	rows, err := db.Query(rebind(qry), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	var cols []exportColumn
+	if table.serverType != "" {
+		cols = append(cols, exportColumn{"server_type", &sql.NullString{String: table.serverType, Valid: true}})
+	}
+	dest := make([]interface{}, len(types))
+	for i, ct := range types {
+		name := ct.Name()
+		if renamed, ok := table.renames[name]; ok {
+			name = renamed
+		}
+		col := newExportColumn(name, ct)
+		cols = append(cols, col)
+		dest[i] = col.value
+	}
+
+	rw, err := newRowWriter(w, opts.Format, cols)
+	if err != nil {
+		return err
+	}
+	row := make([]interface{}, len(cols))
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for i := range cols {
+			row[i] = cols[i].get()
+		}
+		if err := rw.WriteRow(row); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return rw.Close()
+}
+
+func newRowWriter(w io.Writer, format string, cols []exportColumn) (rowWriter, error) {
+	switch format {
+	case FormatCSV:
+		cw := &csvRowWriter{w: csv.NewWriter(w)}
+		header := make([]string, len(cols))
+		for i, col := range cols {
+			header[i] = col.name
+		}
+		return cw, cw.w.Write(header)
+	case FormatJSONL:
+		return &jsonRowWriter{w: w, cols: cols}, nil
+	case FormatParquet:
+		fields := make([]string, len(cols))
+		for i, col := range cols {
+			fields[i] = fmt.Sprintf(`{"Tag": "name=%s, %s, repetitiontype=OPTIONAL"}`, col.name, col.parquetType())
+		}
+		schema := `{"Tag": "name=parquet_go_root, repetitiontype=REQUIRED", "Fields": [` + strings.Join(fields, ", ") + `]}`
+		pw, err := writer.NewJSONWriterFromWriter(schema, w, 1)
+		if err != nil {
+			return nil, err
+		}
+		pw.RowGroupSize = parquetRowGroupSize
+		return &parquetRowWriter{w: pw, cols: cols}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+type csvRowWriter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func (cw *csvRowWriter) WriteRow(row []interface{}) error {
+	cw.record = cw.record[:0]
+	for _, v := range row {
+		switch v := v.(type) {
+		case nil:
+			cw.record = append(cw.record, "")
+		case int64:
+			cw.record = append(cw.record, strconv.FormatInt(v, 10))
+		case float64:
+			cw.record = append(cw.record, strconv.FormatFloat(v, 'g', -1, 64))
+		default:
+			cw.record = append(cw.record, fmt.Sprint(v))
+		}
+	}
+	return cw.w.Write(cw.record)
+}
+
+func (cw *csvRowWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type jsonRowWriter struct {
+	w    io.Writer
+	cols []exportColumn
+	buf  bytes.Buffer
+}
+
+// encode writes the row as a JSON object, keeping the order of the columns.
+// NULL values are left out if omitNull is set.
+func (jw *jsonRowWriter) encode(row []interface{}, omitNull bool) error {
+	jw.buf.Reset()
+	jw.buf.WriteByte('{')
+	first := true
+	for i, v := range row {
+		if v == nil && omitNull {
+			continue
+		}
+		if !first {
+			jw.buf.WriteByte(',')
+		}
+		first = false
+		name, _ := json.Marshal(jw.cols[i].name)
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		jw.buf.Write(name)
+		jw.buf.WriteByte(':')
+		jw.buf.Write(value)
+	}
+	jw.buf.WriteByte('}')
+	return nil
+}
+
+func (jw *jsonRowWriter) WriteRow(row []interface{}) error {
+	if err := jw.encode(row, false); err != nil {
+		return err
+	}
+	jw.buf.WriteByte('\n')
+	_, err := jw.w.Write(jw.buf.Bytes())
+	return err
+}
+
+func (jw *jsonRowWriter) Close() error {
+	return nil
+}
+
+type parquetRowWriter struct {
+	w    *writer.JSONWriter
+	cols []exportColumn
+	enc  jsonRowWriter
+}
+
+func (pw *parquetRowWriter) WriteRow(row []interface{}) error {
+	pw.enc.cols = pw.cols
+	if err := pw.enc.encode(row, true); err != nil {
+		return err
+	}
+	return pw.w.Write(pw.enc.buf.String())
+}
+
+func (pw *parquetRowWriter) Close() error {
+	return pw.w.WriteStop()
+}
+
+// parseExportTime parses either seconds since the epoch, a date such as
+// "2022-05-01" or an RFC 3339 timestamp. An empty string is returned as 0.
+func parseExportTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t.Unix(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q as a time", s)
+	}
+	return t.Unix(), nil
+}
+
+// exportCommand implements "panopticon export".
+func exportCommand(args []string) {
+	if err := loadConfig(configPath()); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.StringVar(dbDriver, "db-driver", *dbDriver, "the database driver to use")
+	fs.StringVar(dbPath, "db", *dbPath, "the data source to use, for sqlite this is the path to the file")
+	fs.StringVar(tenantsConfig, "tenants-config", *tenantsConfig, "the JSON file listing tenants")
+	tenant := fs.String("tenant", "", "the tenant whose database to export from, if not the default one")
+	table := fs.String("table", "stats", "the table to export: stats, dendrite_stats or aggregate_stats")
+	format := fs.String("format", FormatCSV, "the format to export as: csv, jsonl or parquet")
+	from := fs.String("from", "", "only export rows from this time onwards (seconds since epoch, YYYY-MM-DD or RFC 3339)")
+	to := fs.String("to", "", "only export rows from before this time")
+	output := fs.String("output", "-", "the file to write to, - for stdout")
+	fs.Parse(args)
+
+	opts := ExportOptions{Table: *table, Format: *format}
+	var err error
+	if opts.From, err = parseExportTime(*from); err != nil {
+		log.Fatalf("Invalid --from: %v", err)
+	}
+	if opts.To, err = parseExportTime(*to); err != nil {
+		log.Fatalf("Invalid --to: %v", err)
+	}
+	if err := opts.validate(); err != nil {
+		log.Fatalf("Invalid export: %v", err)
+	}
+
+	dsn, err := tenantDatabase(*tenantsConfig, *tenant)
+	if err != nil {
+		log.Fatalf("Invalid --tenant: %v", err)
+	}
+	db, err := openDB(dsn)
+	if err != nil {
+		log.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close()
+
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			log.Fatalf("Could not create output: %v", err)
+		}
+	}
+	if err := Export(db, out, opts); err != nil {
+		log.Fatalf("Error exporting %s: %v", opts.Table, err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatalf("Error exporting %s: %v", opts.Table, err)
+	}
+}
+
+// ExportHandler serves exports over HTTP, taking the same options as
+// "panopticon export" as query parameters.
+type ExportHandler struct {
+	DB *sql.DB
+}
+
+var exportContentTypes = map[string]string{
+	FormatCSV:     "text/csv",
+	FormatJSONL:   "application/jsonl",
+	FormatParquet: "application/vnd.apache.parquet",
+}
+
+func (h *ExportHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	opts := ExportOptions{Table: q.Get("table"), Format: q.Get("format")}
+	if opts.Format == "" {
+		opts.Format = FormatCSV
+	}
+	var err error
+	if opts.From, err = parseExportTime(q.Get("from")); err != nil {
+		logAndReplyError(w, err, 400, "Error parsing from")
+		return
+	}
+	if opts.To, err = parseExportTime(q.Get("to")); err != nil {
+		logAndReplyError(w, err, 400, "Error parsing to")
+		return
+	}
+	if err := opts.validate(); err != nil {
+		logAndReplyError(w, err, 400, "Invalid export")
+		return
+	}
+
+	w.Header().Set("Content-Type", exportContentTypes[opts.Format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", opts.Table, opts.Format))
+	if err := Export(h.DB, w, opts); err != nil {
+		// the response has most likely started, so all we can do is log
+		log.Printf("Error exporting %s: %v", opts.Table, err)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errPrivateTarget is returned when reaching a homeserver would mean
+// connecting to a loopback, private or otherwise internal address.
+var errPrivateTarget = errors.New("refusing to connect to internal address")
+
+// federationPort is the port homeservers are reached on when neither their
+// name, their .well-known delegation nor SRV records give one.
+const federationPort = "8448"
+
+// publicIP returns whether we may connect to ip on behalf of a homeserver.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// dialTarget redirects connections to Addr, such as "example.org:443", to
+// Target, such as the host and port of an SRV record.
+type dialTarget struct {
+	Addr   string
+	Target string
+}
+
+type dialTargetKey struct{}
+
+// newFederationClient returns a client for requests to homeservers, whose
+// names are chosen by whoever sends a report. Unless allowPrivate is set, it
+// refuses to connect to internal addresses however they were reached, so
+// that a report cannot make us fetch from our own network.
+func newFederationClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("%w %s", errPrivateTarget, host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if t, ok := ctx.Value(dialTargetKey{}).(dialTarget); ok && t.Addr == addr {
+			addr = t.Target
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// fetchWellKnown returns the m.server of the .well-known/matrix/server file
+// at url, or "" if there is none.
+func fetchWellKnown(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	} else if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("well-known responded with %s", resp.Status)
+	}
+	var wellKnown struct {
+		Server string `json:"m.server"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&wellKnown); err != nil {
+		return "", fmt.Errorf("invalid well-known: %w", err)
+	}
+	return wellKnown.Server, nil
+}
+
+// ServerResolver finds where to reach a homeserver over federation, as in
+// https://spec.matrix.org/latest/server-server-api/#resolving-server-names
+type ServerResolver struct {
+	Client    *http.Client
+	LookupSRV func(service, proto, name string) (string, []*net.SRV, error)
+}
+
+// federationServer is where a homeserver is reached: the host, and port if
+// any, of the URLs to request, which its certificate must be valid for, and
+// the address to connect to.
+type federationServer struct {
+	Host string
+	Addr string
+}
+
+// URL returns the URL of path on the server, along with a context which makes
+// a federation client connect to the right address for it.
+func (s federationServer) URL(ctx context.Context, path string) (string, context.Context) {
+	addr := s.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(serverHost(addr), "443")
+	}
+	return "https://" + s.Host + path, context.WithValue(ctx, dialTargetKey{}, dialTarget{Addr: addr, Target: s.Addr})
+}
+
+func (r *ServerResolver) Resolve(serverName string) (federationServer, error) {
+	host, port := splitServerName(serverName)
+	if host == "" {
+		return federationServer{}, fmt.Errorf("invalid server name %q", serverName)
+	}
+	if net.ParseIP(host) != nil || port != "" {
+		return fixedServer(host, port), nil
+	}
+
+	// a failing .well-known is treated as there being none
+	delegated, err := fetchWellKnown(r.Client, "https://"+host+"/.well-known/matrix/server")
+	if err == nil && delegated != "" {
+		dhost, dport := splitServerName(delegated)
+		if dhost == "" {
+			return federationServer{}, fmt.Errorf("invalid delegation of %s to %q", serverName, delegated)
+		}
+		if net.ParseIP(dhost) != nil || dport != "" {
+			return fixedServer(dhost, dport), nil
+		}
+		host = dhost
+	}
+	if target := r.lookupSRV(host); target != "" {
+		return federationServer{Host: host, Addr: target}, nil
+	}
+	return fixedServer(host, ""), nil
+}
+
+// fixedServer is a server whose address is its host and port, or the
+// federation port if it has none.
+func fixedServer(host, port string) federationServer {
+	if port == "" {
+		port = federationPort
+	}
+	addr := net.JoinHostPort(host, port)
+	return federationServer{Host: addr, Addr: addr}
+}
+
+// lookupSRV returns the host and port of the federation SRV record of host,
+// or "" if it has none.
+func (r *ServerResolver) lookupSRV(host string) string {
+	for _, service := range []string{"matrix-fed", "matrix"} {
+		_, addrs, err := r.LookupSRV(service, "tcp", host)
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		return net.JoinHostPort(strings.TrimSuffix(addrs[0].Target, "."), fmt.Sprint(addrs[0].Port))
+	}
+	return ""
+}
+
+// splitServerName splits a server name into its host, without the brackets
+// of an IPv6 literal, and its port, if any.
+func splitServerName(name string) (host, port string) {
+	if h, p, err := net.SplitHostPort(name); err == nil {
+		return h, p
+	}
+	return serverHost(name), ""
+}
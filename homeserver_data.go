@@ -0,0 +1,464 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// homeserverDataTable is a table holding data about individual homeservers.
+type homeserverDataTable struct {
+	name   string
+	column string // naming the homeserver of each row
+	clear  bool   // if set, erasing sets column to NULL rather than deleting the rows
+	shared bool   // if set, the table is kept in the default database, whichever tenant the homeserver reports to
+
+	// For tables whose primary key includes column, the rest of the key,
+	// the other columns, and the assignments merging a row into the one
+	// with the same key once its homeserver is renamed, in the form taken by
+	// onConflict. Assignments to a column the others read come last, as
+	// MySQL applies them in order.
+	key, columns, merge string
+}
+
+// homeserverDataTables are every table which can hold data about a
+// homeserver, for when its operator asks us to export or erase it.
+// aggregate_carried_forward is created by the aggregator, so may not exist.
+var homeserverDataTables = []homeserverDataTable{
+	{name: "stats", column: "homeserver"},
+	{name: "dendrite_stats", column: "homeserver"},
+	{name: "homeservers", column: "homeserver"},
+	{name: "homeserver_events", column: "homeserver"},
+	{
+		name: "homeserver_networks", column: "homeserver",
+		key: "network", columns: "first_seen, last_seen, report_count",
+		merge: `first_seen = CASE WHEN excluded.first_seen < first_seen THEN excluded.first_seen ELSE first_seen END,
+			last_seen = CASE WHEN excluded.last_seen > last_seen THEN excluded.last_seen ELSE last_seen END,
+			report_count = report_count + excluded.report_count`,
+	},
+	{
+		name: "homeserver_network_days", column: "homeserver",
+		key: "network, day", columns: "report_count",
+		merge: "report_count = report_count + excluded.report_count",
+	},
+	{
+		name: "homeserver_verifications", column: "homeserver",
+		columns: "checked_at, delegated_server, resolved_ips, reporting_ip, ip_matches, error",
+		merge: `delegated_server = CASE WHEN excluded.checked_at > checked_at THEN excluded.delegated_server ELSE delegated_server END,
+			resolved_ips = CASE WHEN excluded.checked_at > checked_at THEN excluded.resolved_ips ELSE resolved_ips END,
+			reporting_ip = CASE WHEN excluded.checked_at > checked_at THEN excluded.reporting_ip ELSE reporting_ip END,
+			ip_matches = CASE WHEN excluded.checked_at > checked_at THEN excluded.ip_matches ELSE ip_matches END,
+			error = CASE WHEN excluded.checked_at > checked_at THEN excluded.error ELSE error END,
+			checked_at = CASE WHEN excluded.checked_at > checked_at THEN excluded.checked_at ELSE checked_at END`,
+	},
+	{name: "quarantine", column: "homeserver"},
+	{name: "auth_token_usage", column: "last_homeserver", clear: true, shared: true},
+	{
+		name: "aggregate_carried_forward", column: "homeserver",
+		key: "day", columns: "local_timestamp",
+		merge: "local_timestamp = CASE WHEN excluded.local_timestamp > local_timestamp THEN excluded.local_timestamp ELSE local_timestamp END",
+	},
+}
+
+func createTableAuditLog(db *sql.DB) error {
+	autoincrement := "AUTOINCREMENT"
+	if *dbDriver == "mysql" {
+		autoincrement = "AUTO_INCREMENT"
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS audit_log(
+		id INTEGER NOT NULL PRIMARY KEY ` + autoincrement + ` ,
+		timestamp BIGINT,
+		actor VARCHAR(256),
+		action VARCHAR(32),
+		homeserver VARCHAR(256),
+		details TEXT
+		)`)
+	return err
+}
+
+// createTableRecomputeRequests creates the table through which the
+// aggregator is asked to aggregate days again, such as after a homeserver's
+// reports for them were erased.
+func createTableRecomputeRequests(db *sql.DB) error {
+	autoincrement := "AUTOINCREMENT"
+	if *dbDriver == "mysql" {
+		autoincrement = "AUTO_INCREMENT"
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS recompute_requests(
+		id INTEGER NOT NULL PRIMARY KEY ` + autoincrement + ` ,
+		from_timestamp BIGINT,
+		to_timestamp BIGINT,
+		requested_at BIGINT,
+		reason TEXT,
+		completed_at BIGINT
+		)`)
+	return err
+}
+
+// audit records an operation on a homeserver's data, both in the audit_log
+// table and in our log.
+func audit(db execer, actor, action, homeserver string, details interface{}) error {
+	var encoded sql.NullString
+	if details != nil {
+		b, err := json.Marshal(details)
+		if err != nil {
+			return err
+		}
+		encoded = sql.NullString{String: string(b), Valid: true}
+	}
+	log.Printf("Audit: %s %s %s %s", actor, action, homeserver, encoded.String)
+	_, err := db.Exec(rebind(`INSERT INTO audit_log (timestamp, actor, action, homeserver, details)
+		VALUES (?, ?, ?, ?, ?)`), time.Now().Unix(), actor, action, homeserver, encoded,
+	)
+	return err
+}
+
+// tableExists returns whether a table exists in the database, according to
+// its catalogue, so that other errors are not mistaken for a missing table.
+func tableExists(db execer, table string) (bool, error) {
+	qry := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	if *dbDriver == "mysql" {
+		qry = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+	}
+	var n int
+	if err := db.QueryRow(qry, table).Scan(&n); err != nil {
+		return false, fmt.Errorf("error checking for table %s: %w", table, err)
+	}
+	return n > 0, nil
+}
+
+// ExportHomeserverData writes everything we hold about a homeserver to w as
+// a single JSON object, with the rows of each table under "tables", reading
+// shared tables from defaultDB and the others from db. It returns how many
+// rows of each table were written.
+func ExportHomeserverData(db, defaultDB *sql.DB, w io.Writer, homeserver string) (map[string]int64, error) {
+	counts := map[string]int64{}
+	name, _ := json.Marshal(homeserver)
+	if _, err := fmt.Fprintf(w, `{"homeserver":%s,"exported_at":%d,"tables":{`, name, time.Now().Unix()); err != nil {
+		return counts, err
+	}
+	first := true
+	for _, t := range homeserverDataTables {
+		tdb := db
+		if t.shared {
+			tdb = defaultDB
+		}
+		exists, err := tableExists(tdb, t.name)
+		if err != nil {
+			return counts, err
+		}
+		if !exists {
+			continue
+		}
+		if !first {
+			io.WriteString(w, ",")
+		}
+		first = false
+		fmt.Fprintf(w, "\n%q:[", t.name)
+		n, err := exportHomeserverRows(tdb, w, t, homeserver)
+		counts[t.name] = n
+		if err != nil {
+			return counts, err
+		}
+		io.WriteString(w, "]")
+	}
+	_, err := io.WriteString(w, "}}\n")
+	return counts, err
+}
+
+func exportHomeserverRows(db *sql.DB, w io.Writer, t homeserverDataTable, homeserver string) (int64, error) {
+	rows, err := db.Query(rebind("SELECT * FROM "+t.name+" WHERE "+t.column+" = ?"), homeserver)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+	cols := make([]exportColumn, len(types))
+	dest := make([]interface{}, len(types))
+	for i, ct := range types {
+		cols[i] = newExportColumn(ct.Name(), ct)
+		dest[i] = cols[i].value
+	}
+	jw := &jsonRowWriter{w: w, cols: cols}
+	row := make([]interface{}, len(cols))
+	var n int64
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return n, err
+		}
+		for i := range cols {
+			row[i] = cols[i].get()
+		}
+		if err := jw.encode(row, false); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			io.WriteString(w, ",")
+		}
+		io.WriteString(w, "\n")
+		if _, err := w.Write(jw.buf.Bytes()); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// Erasure is what erasing a homeserver's data did.
+type Erasure struct {
+	Homeserver string           `json:"homeserver"`
+	Rows       map[string]int64 `json:"rows"` // deleted, or cleared, from each table
+	// the range of report and event timestamps erased, if the days covering
+	// it are to be aggregated again
+	RecomputeFrom int64 `json:"recompute_from,omitempty"`
+	RecomputeTo   int64 `json:"recompute_to,omitempty"`
+}
+
+// EraseHomeserverData deletes everything we hold about a homeserver, in a
+// single transaction along with the audit log entry. Shared tables are
+// erased from defaultDB, in a transaction committed after that one when it
+// is not db. If recompute is set, the aggregator is asked to aggregate the
+// affected days again.
+func EraseHomeserverData(db, defaultDB *sql.DB, homeserver, actor string, recompute bool) (*Erasure, error) {
+	e := &Erasure{Homeserver: homeserver, Rows: map[string]int64{}}
+	var exists []homeserverDataTable
+	for _, t := range homeserverDataTables {
+		tdb := db
+		if t.shared {
+			tdb = defaultDB
+		}
+		ok, err := tableExists(tdb, t.name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			exists = append(exists, t)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	sharedTx := tx
+	if defaultDB != db {
+		if sharedTx, err = defaultDB.Begin(); err != nil {
+			return nil, err
+		}
+		defer sharedTx.Rollback()
+	}
+
+	if recompute {
+		var from, to sql.NullInt64
+		if err := tx.QueryRow(rebind(`SELECT MIN(t), MAX(t) FROM (
+			SELECT local_timestamp AS t FROM stats WHERE homeserver = ?
+			UNION ALL SELECT local_timestamp FROM dendrite_stats WHERE homeserver = ?
+			UNION ALL SELECT timestamp FROM homeserver_events WHERE homeserver = ?
+			) erased`), homeserver, homeserver, homeserver,
+		).Scan(&from, &to); err != nil {
+			return nil, err
+		}
+		if from.Valid {
+			e.RecomputeFrom, e.RecomputeTo = from.Int64, to.Int64
+			if _, err := tx.Exec(rebind(`INSERT INTO recompute_requests (from_timestamp, to_timestamp, requested_at, reason)
+				VALUES (?, ?, ?, ?)`), from.Int64, to.Int64, time.Now().Unix(), "erased "+homeserver,
+			); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, t := range exists {
+		qry := "DELETE FROM " + t.name + " WHERE " + t.column + " = ?"
+		if t.clear {
+			qry = "UPDATE " + t.name + " SET " + t.column + " = NULL WHERE " + t.column + " = ?"
+		}
+		ttx := tx
+		if t.shared {
+			ttx = sharedTx
+		}
+		res, err := ttx.Exec(rebind(qry), homeserver)
+		if err != nil {
+			return nil, fmt.Errorf("erasing from %s: %w", t.name, err)
+		}
+		if e.Rows[t.name], err = res.RowsAffected(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := audit(tx, actor, "erase", homeserver, e); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if sharedTx != tx {
+		return e, sharedTx.Commit()
+	}
+	return e, nil
+}
+
+// HomeserverExportHandler serves everything we hold about the homeserver
+// given by the homeserver query parameter.
+type HomeserverExportHandler struct {
+	DB        *sql.DB
+	DefaultDB *sql.DB // holding the shared tables
+}
+
+func (h *HomeserverExportHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	homeserver, err := normalizeServerName(req.URL.Query().Get("homeserver"))
+	if err != nil {
+		logAndReplyError(w, err, 400, "Invalid homeserver")
+		return
+	}
+	actor := "http:" + req.RemoteAddr
+	// the export is audited before it starts, as it cannot be taken back
+	// once it has been sent
+	if err := audit(h.DB, actor, "export", homeserver, nil); err != nil {
+		logAndReplyError(w, err, 500, "Error auditing export")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.json", homeserver))
+	if _, err := ExportHomeserverData(h.DB, h.DefaultDB, w, homeserver); err != nil {
+		// only logged, for the reason given in ExportHandler.ServeHTTP
+		log.Printf("Error exporting data of %s: %v", homeserver, err)
+	}
+}
+
+// HomeserverEraseHandler erases everything we hold about the homeserver
+// given by the homeserver query parameter when an admin POSTs to it. The
+// affected days are aggregated again if recompute is true.
+type HomeserverEraseHandler struct {
+	DB        *sql.DB
+	DefaultDB *sql.DB // holding the shared tables
+}
+
+func (h *HomeserverEraseHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	homeserver, err := normalizeServerName(q.Get("homeserver"))
+	if err != nil {
+		logAndReplyError(w, err, 400, "Invalid homeserver")
+		return
+	}
+	var recompute bool
+	if s := q.Get("recompute"); s != "" {
+		if recompute, err = strconv.ParseBool(s); err != nil {
+			logAndReplyError(w, err, 400, "Invalid recompute")
+			return
+		}
+	}
+	e, err := EraseHomeserverData(h.DB, h.DefaultDB, homeserver, "http:"+req.RemoteAddr, recompute)
+	if err != nil {
+		logAndReplyError(w, err, 500, "Error erasing data")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
+
+// homeserverDataCommand implements "panopticon homeserver-data".
+func homeserverDataCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: panopticon homeserver-data export|erase --homeserver=NAME [flags]")
+	}
+	if err := loadConfig(configPath()); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	fs := flag.NewFlagSet("homeserver-data "+args[0], flag.ExitOnError)
+	fs.StringVar(dbDriver, "db-driver", *dbDriver, "the database driver to use")
+	fs.StringVar(dbPath, "db", *dbPath, "the data source to use, for sqlite this is the path to the file")
+	fs.StringVar(tenantsConfig, "tenants-config", *tenantsConfig, "the JSON file listing tenants")
+	tenant := fs.String("tenant", "", "the tenant whose database holds the homeserver's data, if not the default one")
+	name := fs.String("homeserver", "", "the name of the homeserver")
+	output := fs.String("output", "-", "export: the file to write to, - for stdout")
+	recompute := fs.Bool("recompute", false, "erase: have the aggregator aggregate the affected days again")
+	fs.Parse(args[1:])
+
+	homeserver, err := normalizeServerName(*name)
+	if err != nil {
+		log.Fatalf("Invalid --homeserver: %v", err)
+	}
+	dsn, err := tenantDatabase(*tenantsConfig, *tenant)
+	if err != nil {
+		log.Fatalf("Invalid --tenant: %v", err)
+	}
+	db, err := openDB(dsn)
+	if err != nil {
+		log.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close()
+	if err := createTables(db); err != nil {
+		log.Fatalf("Error creating database: %v", err)
+	}
+	// the shared tables are in the default database
+	defaultDB := db
+	if dsn != *dbPath {
+		if defaultDB, err = openDB(*dbPath); err != nil {
+			log.Fatalf("Could not open database: %v", err)
+		}
+		defer defaultDB.Close()
+	}
+
+	actor := "cli"
+	if u, err := user.Current(); err == nil {
+		actor += ":" + u.Username
+	}
+	switch args[0] {
+	case "export":
+		out := os.Stdout
+		if *output != "-" {
+			if out, err = os.Create(*output); err != nil {
+				log.Fatalf("Could not create output: %v", err)
+			}
+		}
+		if err := audit(db, actor, "export", homeserver, nil); err != nil {
+			log.Fatalf("Error auditing export: %v", err)
+		}
+		if _, err := ExportHomeserverData(db, defaultDB, out, homeserver); err != nil {
+			log.Fatalf("Error exporting data of %s: %v", homeserver, err)
+		}
+		if err := out.Close(); err != nil {
+			log.Fatalf("Error exporting data of %s: %v", homeserver, err)
+		}
+	case "erase":
+		e, err := EraseHomeserverData(db, defaultDB, homeserver, actor, *recompute)
+		if err != nil {
+			log.Fatalf("Error erasing data of %s: %v", homeserver, err)
+		}
+		json.NewEncoder(os.Stdout).Encode(e)
+	default:
+		log.Fatalf("Unknown homeserver-data command %q: expected export or erase", args[0])
+	}
+}
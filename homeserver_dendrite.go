@@ -88,13 +88,45 @@ func createTableDendrite(db *sql.DB) error {
 		nats_in_memory INT,
 		num_cpu INT,
 		num_go_routine INT,
-		version TEXT
+		version TEXT,
+		clock_skew_seconds BIGINT,
+		timestamp_flag VARCHAR(16),
+		original_homeserver VARCHAR(256),
+		excluded INT,
+		tags TEXT,
+		trust_score DOUBLE,
+		verified INT,
+		client_cert_subject TEXT
 		)`)
+	if err != nil {
+		return err
+	}
 
-	return err
+	if err := addColumnIfMissing(db, "dendrite_stats", "clock_skew_seconds", "BIGINT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "dendrite_stats", "timestamp_flag", "VARCHAR(16)"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "dendrite_stats", "original_homeserver", "VARCHAR(256)"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "dendrite_stats", "excluded", "INT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "dendrite_stats", "tags", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "dendrite_stats", "trust_score", "DOUBLE"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "dendrite_stats", "verified", "INT"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(db, "dendrite_stats", "client_cert_subject", "TEXT")
 }
 
-func (sr *ReportStatsDendrite) Save(db *sql.DB) error {
+func (sr *ReportStatsDendrite) Save(db execer) error {
 	cols := []string{"homeserver", "local_timestamp", "remote_addr"}
 	vals := []interface{}{sr.Common.Homeserver, sr.Common.LocalTimestamp, sr.Common.RemoteAddr}
 
@@ -139,6 +171,15 @@ func (sr *ReportStatsDendrite) Save(db *sql.DB) error {
 
 	cols, vals = appendIfNonEmpty(cols, vals, "log_level", sr.Common.LogLevel)
 
+	cols, vals = appendIfNonNil(cols, vals, "clock_skew_seconds", sr.Common.ClockSkewSeconds)
+	cols, vals = appendIfNonEmpty(cols, vals, "timestamp_flag", sr.Common.TimestampFlag)
+	cols, vals = appendIfNonEmpty(cols, vals, "original_homeserver", sr.Common.OriginalHomeserver)
+	cols, vals = appendIfTrue(cols, vals, "excluded", sr.Common.Excluded)
+	cols, vals = appendIfNonEmpty(cols, vals, "tags", sr.Common.Tags)
+	cols, vals = appendIfNonNilFloat(cols, vals, "trust_score", sr.Common.TrustScore)
+	cols, vals = appendIfNonNilBool(cols, vals, "verified", sr.Common.Verified)
+	cols, vals = appendIfNonEmpty(cols, vals, "client_cert_subject", sr.Common.ClientCertSubject)
+
 	cols, vals = appendIfNonEmpty(cols, vals, "goos", sr.GoOS)
 	cols, vals = appendIfNonEmpty(cols, vals, "goarch", sr.GoArch)
 	cols, vals = appendIfNonEmpty(cols, vals, "goversion", sr.GoVersion)
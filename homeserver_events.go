@@ -0,0 +1,214 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Types of HomeserverEvent
+const (
+	EventRestart           = "restart"
+	EventUpgrade           = "upgrade"
+	EventDowngrade         = "downgrade"
+	EventDatabaseMigration = "database_migration"
+	EventRuntimeChange     = "runtime_change"
+)
+
+// HomeserverEvent is a change noticed between two consecutive reports from
+// the same homeserver.
+type HomeserverEvent struct {
+	Homeserver string `json:"homeserver"`
+	Timestamp  int64  `json:"timestamp"` // LocalTimestamp of the report which caused the event
+	Type       string `json:"type"`
+	OldValue   string `json:"old_value"`
+	NewValue   string `json:"new_value"`
+}
+
+func createTableHomeserverEvents(db *sql.DB) error {
+	autoincrement := "AUTOINCREMENT"
+	if *dbDriver == "mysql" {
+		autoincrement = "AUTO_INCREMENT"
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS homeserver_events(
+		id INTEGER NOT NULL PRIMARY KEY ` + autoincrement + ` ,
+		homeserver VARCHAR(256),
+		timestamp BIGINT,
+		event_type VARCHAR(32),
+		old_value TEXT,
+		new_value TEXT
+		)`)
+
+	return err
+}
+
+func (ev *HomeserverEvent) Save(db execer) error {
+	_, err := db.Exec(rebind(`INSERT INTO homeserver_events
+		(homeserver, timestamp, event_type, old_value, new_value) VALUES (?, ?, ?, ?, ?)`),
+		ev.Homeserver, ev.Timestamp, ev.Type, ev.OldValue, ev.NewValue,
+	)
+	return err
+}
+
+// detectEvents compares a report with the previous report from the same
+// homeserver. Fields which are missing from either report are ignored.
+func detectEvents(prev, cur HomeserverReport) []HomeserverEvent {
+	var events []HomeserverEvent
+	add := func(typ, oldValue, newValue string) {
+		events = append(events, HomeserverEvent{
+			Homeserver: cur.Homeserver,
+			Timestamp:  cur.Timestamp,
+			Type:       typ,
+			OldValue:   oldValue,
+			NewValue:   newValue,
+		})
+	}
+
+	if prev.UptimeSeconds != nil && cur.UptimeSeconds != nil && *cur.UptimeSeconds < *prev.UptimeSeconds {
+		add(EventRestart, strconv.FormatInt(*prev.UptimeSeconds, 10), strconv.FormatInt(*cur.UptimeSeconds, 10))
+	}
+	if prev.Version != "" && cur.Version != "" {
+		if c := compareVersions(cur.Version, prev.Version); c > 0 {
+			add(EventUpgrade, prev.Version, cur.Version)
+		} else if c < 0 {
+			add(EventDowngrade, prev.Version, cur.Version)
+		}
+	}
+	if prev.DatabaseEngine != "" && cur.DatabaseEngine != "" && !strings.EqualFold(prev.DatabaseEngine, cur.DatabaseEngine) {
+		add(EventDatabaseMigration, prev.DatabaseEngine, cur.DatabaseEngine)
+	}
+	if prev.Runtime != "" && cur.Runtime != "" && prev.Runtime != cur.Runtime {
+		add(EventRuntimeChange, prev.Runtime, cur.Runtime)
+	}
+	return events
+}
+
+// compareVersions compares two dotted version strings such as "1.59.0" and
+// "1.60.0rc1", returning -1, 0 or 1. Components are compared numerically
+// where they start with a number, and as strings otherwise.
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var ap, bp string
+		if i < len(as) {
+			ap = as[i]
+		}
+		if i < len(bs) {
+			bp = bs[i]
+		}
+		an, arest := splitNumber(ap)
+		bn, brest := splitNumber(bp)
+		if an != bn {
+			if an < bn {
+				return -1
+			}
+			return 1
+		}
+		if arest != brest {
+			// a suffix such as "rc1" sorts before the bare release
+			if arest == "" {
+				return 1
+			} else if brest == "" {
+				return -1
+			} else if arest < brest {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// splitNumber splits a version component into its leading number and the rest.
+func splitNumber(s string) (int64, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	n, _ := strconv.ParseInt(s[:i], 10, 64)
+	return n, s[i:]
+}
+
+// EventsHandler serves the events recorded for homeservers, optionally
+// filtered by the homeserver, type and time range query parameters.
+type EventsHandler struct {
+	DB *sql.DB
+}
+
+func (h *EventsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	var conds []string
+	var args []interface{}
+	if hs := q.Get("homeserver"); hs != "" {
+		conds = append(conds, "homeserver = ?")
+		args = append(args, hs)
+	}
+	if typ := q.Get("type"); typ != "" {
+		conds = append(conds, "event_type = ?")
+		args = append(args, typ)
+	}
+	for param, cond := range map[string]string{"since": "timestamp >= ?", "until": "timestamp < ?"} {
+		if v := q.Get(param); v != "" {
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				logAndReplyError(w, err, 400, "Error parsing "+param)
+				return
+			}
+			conds = append(conds, cond)
+			args = append(args, ts)
+		}
+	}
+	limit := int64(100)
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.ParseInt(v, 10, 64); err != nil || limit <= 0 {
+			logAndReplyError(w, err, 400, "Error parsing limit")
+			return
+		}
+	}
+
+	qry := "SELECT homeserver, timestamp, event_type, old_value, new_value FROM homeserver_events"
+	if len(conds) > 0 {
+		qry += " WHERE " + strings.Join(conds, " AND ")
+	}
+	qry += " ORDER BY timestamp DESC, id DESC LIMIT " + strconv.FormatInt(limit, 10)
+	rows, err := h.DB.Query(rebind(qry), args...)
+	if err != nil {
+		logAndReplyError(w, err, 500, "Error querying events")
+		return
+	}
+	defer rows.Close()
+
+	events := []HomeserverEvent{}
+	for rows.Next() {
+		var ev HomeserverEvent
+		if err := rows.Scan(&ev.Homeserver, &ev.Timestamp, &ev.Type, &ev.OldValue, &ev.NewValue); err != nil {
+			logAndReplyError(w, err, 500, "Error querying events")
+			return
+		}
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		logAndReplyError(w, err, 500, "Error querying events")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"events": events})
+}
@@ -75,13 +75,45 @@ func createTableSynapse(db *sql.DB) error {
 		database_engine TEXT,
 		database_server_version TEXT,
 		server_context TEXT,
-		log_level TEXT
+		log_level TEXT,
+		clock_skew_seconds BIGINT,
+		timestamp_flag VARCHAR(16),
+		original_homeserver VARCHAR(256),
+		excluded INT,
+		tags TEXT,
+		trust_score DOUBLE,
+		verified INT,
+		client_cert_subject TEXT
 		)`)
+	if err != nil {
+		return err
+	}
 
-	return err
+	if err := addColumnIfMissing(db, "stats", "clock_skew_seconds", "BIGINT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "stats", "timestamp_flag", "VARCHAR(16)"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "stats", "original_homeserver", "VARCHAR(256)"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "stats", "excluded", "INT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "stats", "tags", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "stats", "trust_score", "DOUBLE"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "stats", "verified", "INT"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(db, "stats", "client_cert_subject", "TEXT")
 }
 
-func (sr *ReportStatsSynapse) Save(db *sql.DB) error {
+func (sr *ReportStatsSynapse) Save(db execer) error {
 	cols := []string{"homeserver", "local_timestamp", "remote_addr"}
 	vals := []interface{}{sr.Homeserver, sr.LocalTimestamp, sr.RemoteAddr}
 
@@ -129,6 +161,15 @@ func (sr *ReportStatsSynapse) Save(db *sql.DB) error {
 	cols, vals = appendIfNonEmpty(cols, vals, "server_context", sr.ServerContext)
 	cols, vals = appendIfNonEmpty(cols, vals, "log_level", sr.LogLevel)
 
+	cols, vals = appendIfNonNil(cols, vals, "clock_skew_seconds", sr.ClockSkewSeconds)
+	cols, vals = appendIfNonEmpty(cols, vals, "timestamp_flag", sr.TimestampFlag)
+	cols, vals = appendIfNonEmpty(cols, vals, "original_homeserver", sr.OriginalHomeserver)
+	cols, vals = appendIfTrue(cols, vals, "excluded", sr.Excluded)
+	cols, vals = appendIfNonEmpty(cols, vals, "tags", sr.Tags)
+	cols, vals = appendIfNonNilFloat(cols, vals, "trust_score", sr.TrustScore)
+	cols, vals = appendIfNonNilBool(cols, vals, "verified", sr.Verified)
+	cols, vals = appendIfNonEmpty(cols, vals, "client_cert_subject", sr.ClientCertSubject)
+
 	var valuePlaceholders []string
 	for i := range vals {
 		if *dbDriver == "mysql" {
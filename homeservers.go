@@ -0,0 +1,194 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"net"
+	"strings"
+)
+
+// HomeserverReport is the part of a stats report which is used to track a
+// homeserver across reports, regardless of the server implementation.
+type HomeserverReport struct {
+	Homeserver string
+	Timestamp  int64 // LocalTimestamp of the report
+	IP         string
+	Software   string // e.g. "Synapse" or "Dendrite"
+	Version    string
+
+	UptimeSeconds  *int64
+	DatabaseEngine string
+	Runtime        string // python_version or go_version
+}
+
+// summary extracts the HomeserverReport from a stats report.
+func (sr *StatsReport) summary(isDendrite bool) HomeserverReport {
+	software, version := softwareVersion(sr.UserAgent)
+	runtime := sr.PythonVersion
+	if isDendrite {
+		software = "Dendrite"
+		if sr.ReportStatsDendrite.Version != "" {
+			version = sr.ReportStatsDendrite.Version
+		}
+		runtime = sr.GoVersion
+	}
+	return HomeserverReport{
+		Homeserver:     sr.Homeserver,
+		Timestamp:      sr.LocalTimestamp,
+		IP:             sr.ClientIP(),
+		Software:       software,
+		Version:        version,
+		UptimeSeconds:  sr.UptimeSeconds,
+		DatabaseEngine: sr.DatabaseEngine,
+		Runtime:        runtime,
+	}
+}
+
+// softwareVersion splits a User-Agent such as "Synapse/1.59.0" into the name
+// and version of the software. Anything after the first space is ignored.
+func softwareVersion(userAgent string) (software, version string) {
+	product := strings.SplitN(userAgent, " ", 2)[0]
+	parts := strings.SplitN(product, "/", 2)
+	if len(parts) != 2 {
+		return product, ""
+	}
+	return parts[0], parts[1]
+}
+
+// remoteIP strips the port from a http.Request.RemoteAddr.
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// proxyNetworks are the networks of --trusted-proxies, set at startup.
+var proxyNetworks []*net.IPNet
+
+// parseNetworks parses a comma-separated list of networks in CIDR notation.
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range splitList(s) {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range proxyNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client which sent a request. When the
+// request comes through trusted proxies, that is the last address in
+// X-Forwarded-For which is not one of theirs, as those before it could have
+// been made up by the client.
+func clientIP(remoteAddr, forwardedFor string) string {
+	ip := remoteIP(remoteAddr)
+	forwarded := strings.Split(forwardedFor, ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		parsed := net.ParseIP(ip)
+		if parsed == nil || !isTrustedProxy(parsed) {
+			break
+		}
+		next := remoteIP(strings.TrimSpace(forwarded[i]))
+		if net.ParseIP(next) == nil {
+			break
+		}
+		ip = next
+	}
+	return ip
+}
+
+// ClientIP returns the address of the client which sent the report.
+func (c *CommonStats) ClientIP() string {
+	return clientIP(c.RemoteAddr, c.XForwardedFor)
+}
+
+func createTableHomeservers(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS homeservers(
+		homeserver VARCHAR(256) NOT NULL PRIMARY KEY,
+		first_seen BIGINT,
+		last_seen BIGINT,
+		report_count BIGINT,
+		software TEXT,
+		last_version TEXT,
+		last_ip TEXT,
+		last_uptime_seconds BIGINT,
+		last_database_engine TEXT,
+		last_runtime TEXT
+		)`)
+
+	return err
+}
+
+// updateHomeserver records a report against the homeserver which sent it,
+// creating the homeserver if this is the first time it has been seen, and
+// records any events detected by comparing it with the previous report.
+func updateHomeserver(db execer, hr HomeserverReport) error {
+	var prev HomeserverReport
+	var version, engine, runtime sql.NullString
+	var uptime sql.NullInt64
+	err := db.QueryRow(rebind(`SELECT last_version, last_uptime_seconds, last_database_engine, last_runtime
+		FROM homeservers WHERE homeserver = ?`), hr.Homeserver,
+	).Scan(&version, &uptime, &engine, &runtime)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		prev.Version = version.String
+		prev.DatabaseEngine = engine.String
+		prev.Runtime = runtime.String
+		if uptime.Valid {
+			prev.UptimeSeconds = &uptime.Int64
+		}
+		for _, ev := range detectEvents(prev, hr) {
+			if err := ev.Save(db); err != nil {
+				return err
+			}
+		}
+	}
+
+	// A single upsert, so that two first reports at once do not both insert.
+	// What a report leaves out is kept from the previous ones, so that the
+	// next report is compared with the last values we know. The address is
+	// NULL rather than "" when it is not stored, as ownership checks tell
+	// the two apart.
+	ip := sql.NullString{String: hr.IP, Valid: hr.IP != ""}
+	_, err = db.Exec(rebind(`INSERT INTO homeservers
+		(homeserver, first_seen, last_seen, report_count, software, last_version, last_ip,
+		last_uptime_seconds, last_database_engine, last_runtime)
+		VALUES (?, ?, ?, 1, ?, ?, ?, ?, ?, ?)`+onConflict("homeserver", `
+		last_seen = excluded.last_seen, report_count = report_count + 1, software = excluded.software,
+		last_version = COALESCE(NULLIF(excluded.last_version, ''), last_version), last_ip = excluded.last_ip,
+		last_uptime_seconds = COALESCE(excluded.last_uptime_seconds, last_uptime_seconds),
+		last_database_engine = COALESCE(NULLIF(excluded.last_database_engine, ''), last_database_engine),
+		last_runtime = COALESCE(NULLIF(excluded.last_runtime, ''), last_runtime)`)),
+		hr.Homeserver, hr.Timestamp, hr.Timestamp, hr.Software, hr.Version, ip,
+		hr.UptimeSeconds, hr.DatabaseEngine, hr.Runtime,
+	)
+	return err
+}
@@ -0,0 +1,125 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// A Listener is one of the HTTP servers panopticon runs: the public one for
+// ingestion, and optionally one for admins.
+type Listener struct {
+	Name         string
+	Addr         string // host:port, or unix: followed by the path of a socket
+	Handler      http.Handler
+	TLSConfig    *tls.Config // nil to serve plain HTTP
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+}
+
+// Serve listens on the address and serves requests until it fails.
+func (l *Listener) Serve() error {
+	ln, err := listen(l.Addr)
+	if err != nil {
+		return fmt.Errorf("%s listener: %w", l.Name, err)
+	}
+	srv := &http.Server{
+		Handler:      l.Handler,
+		TLSConfig:    l.TLSConfig,
+		ReadTimeout:  l.ReadTimeout,
+		WriteTimeout: l.WriteTimeout,
+		IdleTimeout:  l.IdleTimeout,
+	}
+	logInfof("Serving %s requests on %s", l.Name, l.Addr)
+	if l.TLSConfig != nil {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	return fmt.Errorf("%s listener: %w", l.Name, err)
+}
+
+// isLocalAddr reports whether an address can only be reached from this host:
+// a Unix socket, or a loopback host.
+func isLocalAddr(addr string) bool {
+	if strings.HasPrefix(addr, "unix:") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listen opens a TCP address, or a Unix socket for addresses starting with
+// "unix:". A socket left over from a previous run is replaced.
+func listen(addr string) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix:")
+	if path == addr {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Only the owner and group of panopticon may connect.
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// requireBearerToken only passes on requests with the given bearer token.
+func requireBearerToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header := req.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(token)) != 1 {
+			logAndReplyError(w, fmt.Errorf("%s from %s", req.URL.Path, req.RemoteAddr), 401, "Unauthorized admin request")
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// healthHandler replies whether panopticon can reach its database.
+func healthHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := db.Ping(); err != nil {
+			logAndReplyError(w, err, 503, "Database unavailable")
+			return
+		}
+		io.WriteString(w, "ok")
+	}
+}
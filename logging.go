@@ -0,0 +1,68 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Levels of logging, from the most verbose. Errors are always logged.
+const (
+	LogDebug = "debug"
+	LogInfo  = "info"
+	LogError = "error"
+)
+
+var logLevels = []string{LogDebug, LogInfo, LogError}
+
+// currentLogLevel is the index in logLevels of the level being logged at.
+var currentLogLevel int32 = 1
+
+func parseLogLevel(level string) (int32, error) {
+	for i, l := range logLevels {
+		if l == level {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", level)
+}
+
+func setLogLevel(level string) error {
+	i, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&currentLogLevel, i)
+	return nil
+}
+
+func logAt(level int32, format string, v ...interface{}) {
+	if atomic.LoadInt32(&currentLogLevel) <= level {
+		log.Printf(format, v...)
+	}
+}
+
+// logDebugf logs the details of what panopticon is doing, such as each report
+// it records.
+func logDebugf(format string, v ...interface{}) {
+	logAt(0, format, v...)
+}
+
+// logInfof logs noteworthy events which are not errors.
+func logInfof(format string, v ...interface{}) {
+	logAt(1, format, v...)
+}
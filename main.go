@@ -22,24 +22,106 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	dbDriver = flag.String("db-driver", "sqlite3", "the database driver to use")
-	dbPath   = flag.String("db", "stats.db", "the data source to use, for sqlite this is the path to the file")
-	port     = flag.Int("port", 9001, "Port on which to serve HTTP")
+	configFile = flag.String("config", "", "path to a TOML config file, instead of PANOPTICON_CONFIG")
+
+	dbDriver   = flag.String("db-driver", "sqlite3", "the database driver to use")
+	dbPath     = flag.String("db", "stats.db", "the data source to use, for sqlite this is the path to the file")
+	dbHost     = flag.String("db-host", "localhost", "the MySQL host to connect to, if --db is not set")
+	dbPort     = flag.Int("db-port", 3306, "the MySQL port to connect to, if --db is not set")
+	dbName     = flag.String("db-name", "", "the MySQL database to use, if --db is not set")
+	dbUser     = flag.String("db-user", "", "the MySQL user to connect as, if --db is not set")
+	dbPassword = flag.String("db-password", "", "the password of --db-user")
+	port       = flag.Int("port", 9001, "Port on which to serve HTTP")
+
+	maxPastSkew             = flag.Duration("max-past-skew", 24*time.Hour, "flag reports whose timestamp is further than this behind our clock")
+	maxFutureSkew           = flag.Duration("max-future-skew", time.Minute, "flag reports whose timestamp is further than this ahead of our clock")
+	suspiciousTimestampMode = flag.String("suspicious-timestamps", "accept", "what to do with reports flagged for their timestamp: accept, reject or quarantine")
+
+	enableExport = flag.Bool("enable-export", false, "serve exports of the stats tables at /export")
+
+	otlpEndpoint      = flag.String("otlp-endpoint", "", "OTLP/HTTP metrics endpoint to forward reports to, e.g. http://localhost:4318/v1/metrics")
+	otlpBatchSize     = flag.Int("otlp-batch-size", 100, "maximum number of reports to send to the OTLP endpoint at once")
+	otlpBatchInterval = flag.Duration("otlp-batch-interval", 10*time.Second, "maximum time to wait before sending a partial batch to the OTLP endpoint")
+	otlpMaxRetries    = flag.Int("otlp-max-retries", 5, "number of times to retry a failed OTLP export before dropping it")
+
+	sinkWebhooks     = flag.String("sink-webhooks", "", "comma-separated URLs to POST every accepted report to")
+	sinkNATSURL      = flag.String("sink-nats-url", "", "NATS server to publish every accepted report to")
+	sinkNATSSubject  = flag.String("sink-nats-subject", "panopticon.reports", "NATS subject to publish reports on")
+	sinkNATSEmbedded = flag.Int("sink-nats-embedded-port", 0, "if set, run an embedded NATS server on this port and publish reports to it")
+	sinkMaxRetries   = flag.Int("sink-max-retries", 5, "number of times to retry publishing a report to a sink before dropping it")
+
+	watchConfig = flag.String("watch-config", "", "path to a JSON file listing homeservers to alert on when they stop reporting")
+
+	rulesConfig         = flag.String("rules-config", "", "path to a JSON file of rules to reject, exclude or tag reports by homeserver name and source network")
+	rulesReloadInterval = flag.Duration("rules-reload-interval", 10*time.Second, "how often to check the rules file for changes; must be positive")
+
+	rateLimit       = flag.Int("rate-limit", 0, "if set, the number of reports each client network may send per --rate-limit-period")
+	rateLimitPeriod = flag.Duration("rate-limit-period", time.Hour, "the period --rate-limit applies to")
+
+	logLevel = flag.String("log-level", LogInfo, "what to log: debug, info or error")
+
+	readTimeout       = flag.Duration("read-timeout", 10*time.Second, "maximum time to read a request to the public listener")
+	writeTimeout      = flag.Duration("write-timeout", time.Minute, "maximum time to write a response on the public listener")
+	idleTimeout       = flag.Duration("idle-timeout", 2*time.Minute, "how long to keep idle connections to the public listener open")
+	adminListen       = flag.String("admin-listen", "", "if set, serve metrics, health, queries and admin APIs on this host:port or unix:/path/to/socket; needs --admin-token unless a socket or loopback address. Without it, they are only served on --port with --admin-token")
+	adminToken        = flag.String("admin-token", "", "if set, the bearer token admin requests must have")
+	adminReadTimeout  = flag.Duration("admin-read-timeout", 30*time.Second, "maximum time to read a request to the admin listener")
+	adminWriteTimeout = flag.Duration("admin-write-timeout", 10*time.Minute, "maximum time to write a response on the admin listener, such as an export")
+	adminIdleTimeout  = flag.Duration("admin-idle-timeout", 2*time.Minute, "how long to keep idle connections to the admin listener open")
+
+	trustHistory    = flag.Duration("trust-history", 30*24*time.Hour, "how far back to look at the networks a homeserver reported from when scoring a report")
+	trustMinReports = flag.Int("trust-min-reports", 3, "number of reports in --trust-history before a homeserver's reports are scored")
+	trustedProxies  = flag.String("trusted-proxies", "", "comma-separated networks, such as 10.0.0.0/8, of reverse proxies whose X-Forwarded-For gives the address of the client")
+
+	verifySignatures = flag.Bool("verify-signatures", false, "verify reports signed with the homeserver's federation signing key")
+	keyServerURL     = flag.String("key-server-url", "", "if set, where to fetch the signing keys of homeservers from, with %s for the server name, rather than from where their name resolves to over federation")
+
+	allowPrivateTargets = flag.Bool("allow-private-targets", false, "allow fetching keys and .well-known files of homeservers from loopback and private addresses, such as when testing")
+
+	wellKnownInterval = flag.Duration("wellknown-check-interval", 0, "if set, how often to check homeservers report from an address their name or .well-known delegation resolves to")
+	wellKnownURL      = flag.String("wellknown-url", "https://%s/.well-known/matrix/server", "where to fetch the .well-known delegation of homeservers from, with %s for the server name")
+	wellKnownMaxAge   = flag.Duration("wellknown-max-age", 24*time.Hour, "how long to keep the result of checking a homeserver before checking it again")
+
+	authTokensFile = flag.String("auth-tokens-file", "", "path to a JSON file of bearer tokens allowed to push reports")
+	authTokensDB   = flag.Bool("auth-tokens-db", false, "allow the bearer tokens in the auth_tokens table to push reports")
+
+	tlsCert           = flag.String("tls-cert", "", "path to a PEM certificate to serve HTTPS with, instead of HTTP")
+	tlsKey            = flag.String("tls-key", "", "path to the PEM private key of --tls-cert")
+	tlsClientCA       = flag.String("tls-client-ca", "", "path to a PEM CA bundle; if set, clients must present a certificate signed by one of these CAs")
+	tlsReloadInterval = flag.Duration("tls-reload-interval", time.Minute, "how often to check the TLS files for changes, besides on SIGHUP; 0 to only reload them on SIGHUP")
+
+	retainReports     = flag.Duration("retain-reports", 0, "if set, delete reports, including quarantined ones, once they are older than this")
+	retainEvents      = flag.Duration("retain-events", 0, "if set, delete homeserver events once they are older than this")
+	retentionInterval = flag.Duration("retention-interval", time.Hour, "how often to delete the data which is older than it is retained for")
+
+	tenantsConfig = flag.String("tenants-config", "", "path to a JSON file of tenants, whose reports are stored in databases of their own")
+
+	storeAddresses = flag.Bool("store-addresses", true, "store the addresses reports come from; trust scores are still computed from their networks")
 )
 
+// maxReportSize is the largest report body we accept, which is also the most
+// which can end up in the quarantine table for one report.
+const maxReportSize = 1 << 20
+
 type StatsReport struct {
 	ReportStatsSynapse
 	ReportStatsDendrite
@@ -48,7 +130,8 @@ type StatsReport struct {
 // CommonStats defines statistics every server should report to be comparable.
 // Uncommon statistics should be added to the specific homeserver struct.
 type CommonStats struct {
-	Homeserver            string
+	Homeserver            string // Normalized by normalizeServerName
+	OriginalHomeserver    string // Homeserver as sent
 	LocalTimestamp        int64  // Seconds since epoch, UTC
 	RemoteTimestamp       *int64 `json:"timestamp"`                // Seconds since epoch, UTC
 	UptimeSeconds         *int64 `json:"uptime_seconds"`           // Seconds since last restart
@@ -84,40 +167,250 @@ type CommonStats struct {
 	RemoteAddr            string
 	XForwardedFor         string
 	UserAgent             string
+	ClockSkewSeconds      *int64   // LocalTimestamp - RemoteTimestamp
+	TimestampFlag         string   // TimestampFuture or TimestampPast if the skew is suspicious
+	Excluded              bool     // by a rule, from the aggregates
+	Tags                  string   // comma-separated tags added by rules and assessTrust
+	TrustScore            *float64 // from assessTrust, nil without enough history
+	ClientCertSubject     string   // of the TLS client certificate the report was sent with
+	Verified              *bool    // whether the signature of the report was verified, nil if unsigned
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "config":
+			configCommand(os.Args[2:])
+			return
+		case "export":
+			exportCommand(os.Args[2:])
+			return
+		case "homeserver-data":
+			homeserverDataCommand(os.Args[2:])
+			return
+		case "normalize-homeservers":
+			normalizeCommand(os.Args[2:])
+			return
+		case "tokens":
+			tokensCommand(os.Args[2:])
+			return
+		}
+	}
 	flag.Parse()
+	if err := loadConfig(configPath()); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
-	db, err := sql.Open(*dbDriver, *dbPath)
+	db, err := openDB(*dbPath)
 	if err != nil {
 		log.Fatalf("Could not open database: %v", err)
 	}
 	defer db.Close()
 
-	if err := createTableSynapse(db); err != nil {
+	if err := createTables(db); err != nil {
 		log.Fatalf("Error creating database: %v", err)
 	}
-	if err := createTableDendrite(db); err != nil {
-		log.Fatalf("Error creating database: %v", err)
+	if proxyNetworks, err = parseNetworks(*trustedProxies); err != nil {
+		log.Fatalf("Invalid --trusted-proxies: %v", err)
 	}
 
-	r := &Recorder{db}
+	tenants, err := openTenants(*tenantsConfig, db)
+	if err != nil {
+		log.Fatalf("Error opening tenants: %v", err)
+	}
+	for _, t := range tenants.All() {
+		if t.Pruner != nil {
+			go t.Pruner.Run(*retentionInterval)
+		}
+		if *wellKnownInterval > 0 {
+			v := &OwnershipVerifier{
+				DB:         t.DB,
+				URLFormat:  *wellKnownURL,
+				Client:     newFederationClient(10*time.Second, *allowPrivateTargets),
+				LookupHost: net.LookupHost,
+				LookupSRV:  net.LookupSRV,
+				MaxAge:     *wellKnownMaxAge,
+				BatchSize:  100,
+			}
+			go v.Run(*wellKnownInterval)
+		}
+	}
 
-	http.HandleFunc("/push", r.Handle)
-	http.HandleFunc("/test", serveText("ok"))
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+	r := &Recorder{Tenants: tenants}
+	if *authTokensFile != "" || *authTokensDB {
+		r.Auth = &TokenAuth{DB: db, UseDB: *authTokensDB}
+		if *authTokensFile != "" {
+			if err := r.Auth.loadTokenFile(*authTokensFile); err != nil {
+				log.Fatalf("Error loading auth tokens: %v", err)
+			}
+		}
+	}
+	if *verifySignatures {
+		client := newFederationClient(10*time.Second, *allowPrivateTargets)
+		r.Keys = &HTTPKeyResolver{
+			URLFormat: *keyServerURL,
+			Client:    client,
+			Servers:   &ServerResolver{Client: client, LookupSRV: net.LookupSRV},
+		}
+	}
+	if *otlpEndpoint != "" {
+		r.OTLP = &OTLPExporter{
+			Endpoint:      *otlpEndpoint,
+			BatchSize:     *otlpBatchSize,
+			BatchInterval: *otlpBatchInterval,
+			MaxRetries:    *otlpMaxRetries,
+		}
+		r.OTLP.Start()
+	}
+	var embeddedNATS string
+	if *sinkNATSEmbedded != 0 {
+		if embeddedNATS, err = startEmbeddedNATS(*sinkNATSEmbedded); err != nil {
+			log.Fatalf("Error starting embedded NATS server: %v", err)
+		}
+	}
+	reloader := &Reloader{Recorder: r, Watcher: &Watcher{Tenants: tenants}, EmbeddedNATS: embeddedNATS}
+	if err := reloader.Start(); err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+	go reloader.Watch(*rulesReloadInterval)
+
+	health := healthHandler(db)
+	public := http.NewServeMux()
+	public.HandleFunc("/push", r.Handle)
+	public.HandleFunc("/push/", r.Handle)
+	public.HandleFunc("/test", serveText("ok"))
+	public.Handle("/healthz", health)
+
+	admin := http.NewServeMux()
+	admin.Handle("/events", tenants.handler(func(db *sql.DB) http.Handler { return &EventsHandler{db} }))
+	admin.Handle("/metrics", promhttp.Handler())
+	if *enableExport {
+		admin.Handle("/export", tenants.handler(func(db *sql.DB) http.Handler { return &ExportHandler{db} }))
+	}
+	admin.Handle("/admin/reload", reloader)
+	admin.Handle("/admin/homeservers/export", tenants.handler(func(db *sql.DB) http.Handler { return &HomeserverExportHandler{db, tenants.Default.DB} }))
+	admin.Handle("/admin/homeservers/erase", tenants.handler(func(db *sql.DB) http.Handler { return &HomeserverEraseHandler{db, tenants.Default.DB} }))
+	var adminHandler http.Handler = admin
+	if *adminToken != "" {
+		adminHandler = requireBearerToken(*adminToken, admin)
+	}
+
+	// Without an admin listener, the admin endpoints are only served on the
+	// public one to those who have the admin token, and not at all otherwise.
+	switch {
+	case *adminListen == "" && *adminToken != "":
+		public.Handle("/", adminHandler)
+	case *adminListen != "":
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", health)
+		mux.Handle("/", adminHandler)
+		go func() {
+			l := &Listener{
+				Name:         "admin",
+				Addr:         *adminListen,
+				Handler:      mux,
+				ReadTimeout:  *adminReadTimeout,
+				WriteTimeout: *adminWriteTimeout,
+				IdleTimeout:  *adminIdleTimeout,
+			}
+			log.Fatal(l.Serve())
+		}()
+	}
+
+	l := &Listener{
+		Name:         "public",
+		Addr:         fmt.Sprintf(":%d", *port),
+		Handler:      public,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+	}
+	if *tlsCert != "" {
+		certs := &TLSReloader{CertFile: *tlsCert, KeyFile: *tlsKey, ClientCAFile: *tlsClientCA}
+		if err := certs.Load(); err != nil {
+			log.Fatalf("Error loading TLS certificate: %v", err)
+		}
+		go certs.Watch(*tlsReloadInterval)
+		l.TLSConfig = certs.Config()
+	}
+	log.Fatal(l.Serve())
+}
+
+// createTables creates the tables panopticon writes to, and migrates them
+// from older versions.
+func createTables(db *sql.DB) error {
+	for _, create := range []func(*sql.DB) error{
+		createTableSynapse,
+		createTableDendrite,
+		createTableHomeservers,
+		createTableHomeserverEvents,
+		createTableQuarantine,
+		createTableHomeserverNetworks,
+		createTableHomeserverVerifications,
+		createTableAuthTokens,
+		createTableAuditLog,
+		createTableRecomputeRequests,
+	} {
+		if err := create(db); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type Recorder struct {
-	DB *sql.DB
+	Tenants *Tenants
+	OTLP    *OTLPExporter // nil if not forwarding reports
+	Keys    KeyResolver   // nil if signatures are not verified
+	Auth    *TokenAuth    // nil if anyone may push reports
+
+	mu   sync.RWMutex
+	live *Reloadable
+}
+
+// Live returns the current reloadable configuration.
+func (r *Recorder) Live() *Reloadable {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.live
+}
+
+func (r *Recorder) setLive(live *Reloadable) {
+	r.mu.Lock()
+	r.live = live
+	r.mu.Unlock()
 }
 
 func (r *Recorder) Handle(w http.ResponseWriter, req *http.Request) {
-	dec := json.NewDecoder(req.Body)
 	defer req.Body.Close()
+	live := r.Live()
+	var token *AuthToken
+	if r.Auth != nil {
+		var err error
+		if token, err = r.Auth.Authenticate(req); err != nil {
+			logAndReplyError(w, err, 401, "Unauthorized")
+			return
+		}
+	}
+	tenant, err := r.Tenants.Select(req, token)
+	switch {
+	case errors.Is(err, errUnknownTenant):
+		logAndReplyError(w, err, 404, "Unknown tenant")
+		return
+	case err != nil:
+		logAndReplyError(w, err, 403, "Tenant not allowed")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxReportSize))
+	if err != nil && len(body) == maxReportSize {
+		logAndReplyError(w, err, 413, "Report too large")
+		return
+	} else if err != nil {
+		logAndReplyError(w, err, 400, "Error reading request")
+		return
+	}
 	var sr StatsReport
-	if err := dec.Decode(&sr); err != nil {
+	if err := json.Unmarshal(body, &sr); err != nil {
 		logAndReplyError(w, err, 400, "Error decoding JSON")
 		return
 	}
@@ -125,20 +418,208 @@ func (r *Recorder) Handle(w http.ResponseWriter, req *http.Request) {
 	sr.RemoteAddr = req.RemoteAddr
 	sr.XForwardedFor = req.Header.Get("X-Forwarded-For")
 	sr.UserAgent = req.Header.Get("User-Agent")
-	if err := r.Save(sr, strings.HasPrefix(sr.UserAgent, "Dendrite")); err != nil {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		sr.ClientCertSubject = req.TLS.PeerCertificates[0].Subject.String()
+	}
+	if err := sr.normalizeHomeserver(); err != nil {
+		logAndReplyError(w, err, 400, "Invalid homeserver name")
+		return
+	}
+	if token != nil && !token.allows(sr.Homeserver) {
+		logAndReplyError(w, fmt.Errorf("token %s used for %s", token.Name, sr.Homeserver), 403, "Token not allowed for this homeserver")
+		return
+	}
+	// The homeserver name is whatever the client claims, so the limit applies
+	// to the network the report comes from, or to its address if that is not
+	// an IP address.
+	ip := sr.ClientIP()
+	client := networkOf(ip)
+	if client == "" {
+		client = ip
+	}
+	if !live.Limiter.Allow(client, time.Now()) {
+		rateLimitedReports.Inc()
+		logAndReplyError(w, fmt.Errorf("%s from %s", sr.Homeserver, sr.RemoteAddr), 429, "Too many reports")
+		return
+	}
+
+	decision := live.Rules.Evaluate(sr.Homeserver, ip)
+	rulesApplied.WithLabelValues(decision.Action).Inc()
+	if decision.Action == RuleReject {
+		logAndReplyError(w, fmt.Errorf("%s from %s", sr.Homeserver, sr.RemoteAddr), 403, "Report rejected by rule")
+		return
+	}
+	sr.Excluded = decision.Action == RuleExclude
+	sr.Tags = strings.Join(decision.Tags, ",")
+
+	if r.Keys != nil {
+		verified := false
+		switch err := verifyReport(body, sr.OriginalHomeserver, client, r.Keys); {
+		case err == nil:
+			verified = true
+			sr.Verified = &verified
+		case errors.Is(err, errKeysUnavailable):
+			log.Printf("Could not verify report: %v", err)
+			sr.Verified = &verified
+		case !errors.Is(err, errNoSignature):
+			logAndReplyError(w, err, 401, "Invalid signature")
+			return
+		}
+	}
+
+	sr.checkClockSkew()
+	if sr.TimestampFlag != "" {
+		suspiciousTimestamps.WithLabelValues(sr.TimestampFlag, *suspiciousTimestampMode).Inc()
+		switch *suspiciousTimestampMode {
+		case "reject":
+			logAndReplyError(w, fmt.Errorf("%s: skew of %ds", sr.Homeserver, *sr.ClockSkewSeconds), 400, "Rejecting report with timestamp in the "+sr.TimestampFlag)
+			return
+		case "quarantine":
+			if !tenant.StoreAddresses {
+				sr.dropAddresses()
+			}
+			if err := quarantine(tenant.DB, sr.CommonStats, "timestamp_"+sr.TimestampFlag, body); err != nil {
+				logAndReplyError(w, err, 500, "Error saving to DB")
+				return
+			}
+			io.WriteString(w, "{}")
+			return
+		}
+	}
+
+	isDendrite := strings.HasPrefix(sr.UserAgent, "Dendrite")
+	if err := r.Save(tenant, &sr, isDendrite); err != nil {
 		logAndReplyError(w, err, 500, "Error saving to DB")
 		return
 	}
+	if token != nil {
+		if err := r.Auth.RecordUse(token, sr.Homeserver, sr.LocalTimestamp); err != nil {
+			log.Printf("Error recording use of token %s: %v", token.Name, err)
+		}
+	}
+	if r.OTLP != nil {
+		r.OTLP.Enqueue(sr, isDendrite, tenant.Name)
+	}
+	if len(live.Sinks) > 0 {
+		env := newReportEnvelope(sr, isDendrite)
+		env.Tenant = tenant.Name
+		for _, sink := range live.Sinks {
+			sink.Enqueue(env)
+		}
+	}
+	logDebugf("Recorded report from %s (%s)", sr.Homeserver, sr.RemoteAddr)
 	io.WriteString(w, "{}")
 }
 
-func (r *Recorder) Save(sr StatsReport, isDendrite bool) error {
+// Save records a report for a tenant, after scoring it by the network it came
+// from. Unless the tenant stores addresses, they are then removed from the
+// report.
+func (r *Recorder) Save(tenant *Tenant, sr *StatsReport, isDendrite bool) error {
+	tx, err := tenant.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := assessTrust(tx, &sr.CommonStats); err != nil {
+		return err
+	}
+	if !tenant.StoreAddresses {
+		sr.dropAddresses()
+	}
 	if isDendrite {
 		s := sr.ReportStatsDendrite
 		s.Common = sr.ReportStatsSynapse.CommonStats
-		return s.Save(r.DB)
+		err = s.Save(tx)
+	} else {
+		err = sr.ReportStatsSynapse.Save(tx)
 	}
-	return sr.ReportStatsSynapse.Save(r.DB)
+	if err != nil {
+		return err
+	}
+	if err := updateHomeserver(tx, sr.summary(isDendrite)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c *CommonStats) dropAddresses() {
+	c.RemoteAddr = ""
+	c.XForwardedFor = ""
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// addColumnIfMissing adds a column to a table created by an older version of
+// panopticon, so that upgrading does not need manual schema changes.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s LIMIT 1", column, table))
+	if err == nil {
+		return rows.Close()
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// rebind rewrites the "?" placeholders in a query into the form expected by
+// the configured database driver.
+func rebind(qry string) string {
+	if *dbDriver == "mysql" {
+		return qry
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range qry {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// excludedColumn matches the references an upsert makes to the values it
+// tried to insert.
+var excludedColumn = regexp.MustCompile(`excluded\.(\w+)`)
+
+// onConflict returns the clause which turns an INSERT into an upsert on the
+// unique key made of the columns in keys, applying the assignments in set to
+// the existing row instead. set refers to the values being inserted as
+// excluded.column, as SQLite does.
+func onConflict(keys, set string) string {
+	if *dbDriver == "mysql" {
+		return " ON DUPLICATE KEY UPDATE " + excludedColumn.ReplaceAllString(set, "VALUES($1)")
+	}
+	return " ON CONFLICT (" + keys + ") DO UPDATE SET " + set
+}
+
+// openDB opens a database with the configured driver. SQLite transactions
+// take the write lock as they begin, since those panopticon makes write, so
+// that concurrent ones wait for each other instead of failing with
+// SQLITE_BUSY when upgrading from a read lock.
+func openDB(dsn string) (*sql.DB, error) {
+	if *dbDriver == "sqlite3" && !strings.Contains(dsn, "_txlock=") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "_txlock=immediate"
+	}
+	return sql.Open(*dbDriver, dsn)
+}
+
+func appendIfTrue(cols []string, vals []interface{}, name string, value bool) ([]string, []interface{}) {
+	if value {
+		cols = append(cols, name)
+		vals = append(vals, 1)
+	}
+	return cols, vals
 }
 
 func appendIfNonNilBool(cols []string, vals []interface{}, name string, value *bool) ([]string, []interface{}) {
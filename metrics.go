@@ -0,0 +1,94 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	clockSkew = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "panopticon",
+		Name:      "report_clock_skew_seconds",
+		Help:      "Difference between our clock and the timestamp of received reports. Negative values are reports from the future.",
+		Buckets:   []float64{-86400, -3600, -300, -60, -10, 0, 10, 60, 300, 3600, 86400, 7 * 86400},
+	})
+	suspiciousTimestamps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "panopticon",
+		Name:      "suspicious_timestamps_total",
+		Help:      "Number of reports flagged for their timestamp, by flag and the action taken.",
+	}, []string{"flag", "action"})
+	watchedOverdue = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "panopticon",
+		Name:      "watched_homeserver_overdue",
+		Help:      "Whether a watched homeserver has missed its expected report.",
+	}, []string{"homeserver"})
+	otlpExported = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "panopticon",
+		Name:      "otlp_exported_reports_total",
+		Help:      "Number of reports exported to the OpenTelemetry collector.",
+	})
+	otlpDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "panopticon",
+		Name:      "otlp_dropped_reports_total",
+		Help:      "Number of reports which could not be exported to the OpenTelemetry collector.",
+	})
+	sinkPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "panopticon",
+		Name:      "sink_published_reports_total",
+		Help:      "Number of reports published to each sink.",
+	}, []string{"sink"})
+	sinkDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "panopticon",
+		Name:      "sink_dropped_reports_total",
+		Help:      "Number of reports which could not be published to each sink.",
+	}, []string{"sink"})
+	rulesApplied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "panopticon",
+		Name:      "rule_actions_total",
+		Help:      "Number of reports by the action decided by the rules.",
+	}, []string{"action"})
+	newNetworkReports = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "panopticon",
+		Name:      "new_network_reports_total",
+		Help:      "Number of reports from an established homeserver sent from a network it had not reported from.",
+	})
+	rowsPruned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "panopticon",
+		Name:      "pruned_rows_total",
+		Help:      "Number of rows deleted from each table once they were older than they are retained for.",
+	}, []string{"table"})
+	rateLimitedReports = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "panopticon",
+		Name:      "rate_limited_reports_total",
+		Help:      "Number of reports refused because their client network sent too many.",
+	})
+	configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "panopticon",
+		Name:      "config_reloads_total",
+		Help:      "Number of attempts to reload the configuration, by whether they succeeded.",
+	}, []string{"result"})
+	configLastReloadSuccessful = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "panopticon",
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last attempt to reload the configuration succeeded.",
+	})
+	configLastReloadTime = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "panopticon",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "When the configuration was last reloaded successfully.",
+	})
+)
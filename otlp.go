@@ -0,0 +1,204 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTLPExporter forwards accepted reports to an OpenTelemetry collector as
+// OTLP/HTTP metrics, encoded as JSON. Reports are batched, and a batch which
+// fails is retried with exponential backoff before being dropped.
+type OTLPExporter struct {
+	Endpoint      string // e.g. http://localhost:4318/v1/metrics
+	BatchSize     int
+	BatchInterval time.Duration
+	MaxRetries    int
+
+	queue   chan otlpResourceMetrics
+	batches chan []otlpResourceMetrics
+}
+
+// otlpQueueSize is how many reports may wait to be exported before new ones
+// are dropped, so that a slow collector never holds up /push.
+const otlpQueueSize = 10000
+
+// otlpBatchQueueSize is how many batches may wait while an earlier one is
+// being retried, before new batches are dropped.
+const otlpBatchQueueSize = 16
+
+func (e *OTLPExporter) Start() {
+	e.queue = make(chan otlpResourceMetrics, otlpQueueSize)
+	e.batches = make(chan []otlpResourceMetrics, otlpBatchQueueSize)
+	go e.run()
+	go e.send()
+}
+
+// Enqueue converts a report for a tenant to OTLP metrics and queues it for
+// export.
+func (e *OTLPExporter) Enqueue(sr StatsReport, isDendrite bool, tenant string) {
+	select {
+	case e.queue <- reportToOTLP(sr, isDendrite, tenant):
+	default:
+		otlpDropped.Add(1)
+	}
+}
+
+func (e *OTLPExporter) run() {
+	ticker := time.NewTicker(e.BatchInterval)
+	defer ticker.Stop()
+	var batch []otlpResourceMetrics
+	for {
+		select {
+		case rm := <-e.queue:
+			batch = append(batch, rm)
+			if len(batch) < e.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		select {
+		case e.batches <- batch:
+		default:
+			log.Printf("Dropping %d reports as earlier batches are still being exported to %s", len(batch), e.Endpoint)
+			otlpDropped.Add(float64(len(batch)))
+		}
+		batch = nil
+	}
+}
+
+// send exports the batches made by run, so that retrying one does not hold
+// up batching.
+func (e *OTLPExporter) send() {
+	for batch := range e.batches {
+		e.export(batch)
+	}
+}
+
+func (e *OTLPExporter) export(batch []otlpResourceMetrics) {
+	req := otlpExportRequest{ResourceMetrics: batch}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := postJSON(e.Endpoint, req)
+		if err == nil {
+			otlpExported.Add(float64(len(batch)))
+			return
+		}
+		if attempt >= e.MaxRetries {
+			log.Printf("Dropping %d reports after failing to export them to %s: %v", len(batch), e.Endpoint, err)
+			otlpDropped.Add(float64(len(batch)))
+			return
+		}
+		log.Printf("Error exporting reports to %s, retrying in %s: %v", e.Endpoint, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// The subset of the OTLP protobuf messages which we send, in their JSON
+// encoding. 64 bit integers are encoded as strings.
+type otlpExportRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name  string    `json:"name"`
+	Gauge otlpGauge `json:"gauge"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpDataPoint struct {
+	TimeUnixNano string `json:"timeUnixNano"`
+	AsInt        string `json:"asInt"`
+}
+
+// reportToOTLP describes the reporting homeserver, and the tenant unless it
+// is the default one, as the resource, and every numeric field of
+// CommonStats which the homeserver sent as a gauge.
+func reportToOTLP(sr StatsReport, isDendrite bool, tenant string) otlpResourceMetrics {
+	hr := sr.summary(isDendrite)
+	attrs := []otlpKeyValue{
+		{"matrix.homeserver.name", otlpAnyValue{hr.Homeserver}},
+		{"matrix.homeserver.type", otlpAnyValue{strings.ToLower(hr.Software)}},
+	}
+	if hr.Version != "" {
+		attrs = append(attrs, otlpKeyValue{"matrix.homeserver.version", otlpAnyValue{hr.Version}})
+	}
+	if tenant != "" {
+		attrs = append(attrs, otlpKeyValue{"panopticon.tenant", otlpAnyValue{tenant}})
+	}
+
+	ts := strconv.FormatInt(time.Unix(sr.LocalTimestamp, 0).UnixNano(), 10)
+	var metrics []otlpMetric
+	v := reflect.ValueOf(sr.CommonStats)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		value, ok := v.Field(i).Interface().(*int64)
+		if name == "" || name == "timestamp" || !ok || value == nil {
+			continue
+		}
+		metrics = append(metrics, otlpMetric{
+			Name: fmt.Sprintf("matrix.homeserver.%s", name),
+			Gauge: otlpGauge{DataPoints: []otlpDataPoint{{
+				TimeUnixNano: ts,
+				AsInt:        strconv.FormatInt(*value, 10),
+			}}},
+		})
+	}
+
+	return otlpResourceMetrics{
+		Resource:     otlpResource{Attributes: attrs},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "panopticon"}, Metrics: metrics}},
+	}
+}
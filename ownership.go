@@ -0,0 +1,179 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func createTableHomeserverVerifications(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS homeserver_verifications(
+		homeserver VARCHAR(256) NOT NULL PRIMARY KEY,
+		checked_at BIGINT,
+		delegated_server TEXT,
+		resolved_ips TEXT,
+		reporting_ip TEXT,
+		ip_matches INT,
+		error TEXT
+		)`)
+
+	return err
+}
+
+// OwnershipVerifier periodically checks that homeservers report from an
+// address their name resolves to, either directly or through the delegation
+// in their .well-known/matrix/server file and SRV records, and records the
+// result in the homeserver_verifications table. Homeservers whose address is
+// not stored are still resolved, but ip_matches is left NULL.
+type OwnershipVerifier struct {
+	DB         *sql.DB
+	URLFormat  string // with %s for the server name, such as "https://%s/.well-known/matrix/server"
+	Client     *http.Client
+	LookupHost func(host string) ([]string, error)
+	LookupSRV  func(service, proto, name string) (string, []*net.SRV, error)
+	MaxAge     time.Duration // how long a result is kept before checking again
+	BatchSize  int           // how many homeservers to check at a time
+}
+
+// OwnershipResult is the outcome of checking a homeserver.
+type OwnershipResult struct {
+	DelegatedServer string
+	ResolvedIPs     []string
+	IPMatches       bool
+	Err             error
+}
+
+func (v *OwnershipVerifier) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := v.checkDue(time.Now()); err != nil {
+			log.Printf("Error verifying homeserver ownership: %v", err)
+		}
+	}
+}
+
+// checkDue checks the homeservers which have not been checked within MaxAge,
+// oldest first.
+func (v *OwnershipVerifier) checkDue(now time.Time) error {
+	rows, err := v.DB.Query(rebind(`SELECT h.homeserver, h.last_ip FROM homeservers h
+		LEFT JOIN homeserver_verifications v ON v.homeserver = h.homeserver
+		WHERE v.checked_at IS NULL OR v.checked_at < ?
+		ORDER BY v.checked_at LIMIT `+fmt.Sprint(v.BatchSize)), now.Add(-v.MaxAge).Unix())
+	if err != nil {
+		return err
+	}
+	due := make(map[string]string)
+	for rows.Next() {
+		var homeserver string
+		var ip sql.NullString
+		if err := rows.Scan(&homeserver, &ip); err != nil {
+			rows.Close()
+			return err
+		}
+		due[homeserver] = ip.String
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for homeserver, ip := range due {
+		res := v.check(homeserver, ip)
+		var errStr sql.NullString
+		if res.Err != nil {
+			errStr = sql.NullString{String: res.Err.Error(), Valid: true}
+		}
+		// addresses stored before they could be NULL are "" when not kept
+		reportingIP := sql.NullString{String: ip, Valid: ip != ""}
+		var ipMatches sql.NullBool
+		if reportingIP.Valid {
+			ipMatches = sql.NullBool{Bool: res.IPMatches, Valid: true}
+		}
+		if _, err := v.DB.Exec(rebind(`DELETE FROM homeserver_verifications WHERE homeserver = ?`), homeserver); err != nil {
+			return err
+		}
+		if _, err := v.DB.Exec(rebind(`INSERT INTO homeserver_verifications
+			(homeserver, checked_at, delegated_server, resolved_ips, reporting_ip, ip_matches, error)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`),
+			homeserver, now.Unix(), res.DelegatedServer, strings.Join(res.ResolvedIPs, ","), reportingIP, ipMatches, errStr,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check resolves the addresses a homeserver may report from, and whether ip
+// is among them. As in ServerResolver.Resolve, the delegated server is
+// looked up through its SRV records unless it has a port or is an IP
+// address.
+func (v *OwnershipVerifier) check(homeserver, ip string) OwnershipResult {
+	res := OwnershipResult{DelegatedServer: homeserver}
+	delegated, err := v.fetchDelegation(homeserver)
+	if err != nil {
+		res.Err = err
+	} else if delegated != "" {
+		res.DelegatedServer = delegated
+	}
+
+	// failing to resolve only matters for the server federation would use
+	resolved := res.DelegatedServer
+	servers := []string{homeserver, res.DelegatedServer}
+	if host, port := splitServerName(res.DelegatedServer); port == "" && net.ParseIP(host) == nil && v.LookupSRV != nil {
+		if target := (&ServerResolver{LookupSRV: v.LookupSRV}).lookupSRV(host); target != "" {
+			resolved = target
+			servers = append(servers, target)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, server := range servers {
+		addrs, err := v.LookupHost(serverHost(server))
+		if err != nil {
+			if server == resolved && res.Err == nil {
+				res.Err = err
+			}
+			continue
+		}
+		for _, addr := range addrs {
+			if !seen[addr] {
+				seen[addr] = true
+				res.ResolvedIPs = append(res.ResolvedIPs, addr)
+			}
+		}
+	}
+	res.IPMatches = seen[ip]
+	return res
+}
+
+// fetchDelegation returns the m.server of a homeserver's .well-known file,
+// or "" if it has none.
+func (v *OwnershipVerifier) fetchDelegation(homeserver string) (string, error) {
+	return fetchWellKnown(v.Client, fmt.Sprintf(v.URLFormat, homeserver))
+}
+
+// serverHost strips the port from a server name, along with the brackets
+// around an IPv6 literal.
+func serverHost(server string) string {
+	if host, _, err := net.SplitHostPort(server); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(server, "["), "]")
+}
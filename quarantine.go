@@ -0,0 +1,49 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+)
+
+func createTableQuarantine(db *sql.DB) error {
+	autoincrement := "AUTOINCREMENT"
+	if *dbDriver == "mysql" {
+		autoincrement = "AUTO_INCREMENT"
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS quarantine(
+		id INTEGER NOT NULL PRIMARY KEY ` + autoincrement + ` ,
+		homeserver VARCHAR(256),
+		local_timestamp BIGINT,
+		remote_addr TEXT,
+		forwarded_for TEXT,
+		user_agent TEXT,
+		reason VARCHAR(64),
+		body TEXT
+		)`)
+
+	return err
+}
+
+// quarantine stores a report which was not accepted into the stats tables,
+// along with the reason it was held back, so that it can be inspected later.
+func quarantine(db execer, c CommonStats, reason string, body []byte) error {
+	_, err := db.Exec(rebind(`INSERT INTO quarantine
+		(homeserver, local_timestamp, remote_addr, forwarded_for, user_agent, reason, body)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		c.Homeserver, c.LocalTimestamp, c.RemoteAddr, c.XForwardedFor, c.UserAgent, reason, string(body),
+	)
+	return err
+}
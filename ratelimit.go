@@ -0,0 +1,48 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter limits how many reports each client may send in each period.
+// Periods are fixed windows, shared by every client, so that the limiter only
+// remembers the clients which reported in the current one.
+type RateLimiter struct {
+	Reports int
+	Period  time.Duration
+
+	mu     sync.Mutex
+	end    time.Time
+	counts map[string]int
+}
+
+// Allow records a report from the client at now, and returns whether it is
+// within the limit.
+func (l *RateLimiter) Allow(client string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !now.Before(l.end) {
+		l.end = now.Truncate(l.Period).Add(l.Period)
+		l.counts = make(map[string]int)
+	}
+	l.counts[client]++
+	return l.counts[client] <= l.Reports
+}
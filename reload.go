@@ -0,0 +1,200 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Reloadable holds the parts of the configuration which can be changed while
+// panopticon is running. It is replaced as a whole on each reload, so that
+// every report is handled with one consistent configuration.
+type Reloadable struct {
+	Rules    *Rules       // nil if every report is accepted
+	Limiter  *RateLimiter // nil if reports are not rate limited
+	Sinks    []*SinkQueue
+	Watch    *WatchConfig // nil if no homeservers are watched
+	LogLevel string
+
+	sinkSettings string // the settings the sinks were made from
+}
+
+// Reloader builds the Reloadable configuration of a Recorder from the
+// settings, and rebuilds it on SIGHUP or when asked to by an admin.
+type Reloader struct {
+	Recorder     *Recorder
+	Watcher      *Watcher
+	EmbeddedNATS string // the URL of the embedded NATS server, if any
+
+	mu sync.Mutex
+}
+
+// Start builds the initial configuration.
+func (rl *Reloader) Start() error {
+	live, err := rl.build(&Reloadable{})
+	if err != nil {
+		return err
+	}
+	rl.swap(&Reloadable{}, live)
+	configLastReloadSuccessful.Set(1)
+	configLastReloadTime.SetToCurrentTime()
+	go rl.Watcher.Run()
+	return nil
+}
+
+// Reload reads the reloadable settings again and, if they are valid, replaces
+// the current configuration with them. Otherwise the current configuration is
+// kept, and the error returned.
+func (rl *Reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	err := rl.reload()
+	if err != nil {
+		log.Printf("Error reloading configuration, keeping the previous one: %v", err)
+		configReloads.WithLabelValues("failure").Inc()
+		configLastReloadSuccessful.Set(0)
+		return err
+	}
+	logInfof("Reloaded configuration")
+	configReloads.WithLabelValues("success").Inc()
+	configLastReloadSuccessful.Set(1)
+	configLastReloadTime.SetToCurrentTime()
+	return nil
+}
+
+func (rl *Reloader) reload() error {
+	restore, err := reloadConfig(configPath())
+	if err != nil {
+		return err
+	}
+	old := rl.Recorder.Live()
+	live, err := rl.build(old)
+	if err != nil {
+		restore()
+		return err
+	}
+	rl.swap(old, live)
+	return nil
+}
+
+// build makes a configuration from the current settings, reusing the parts of
+// old which have not changed.
+func (rl *Reloader) build(old *Reloadable) (*Reloadable, error) {
+	if _, err := parseLogLevel(*logLevel); err != nil {
+		return nil, err
+	}
+	live := &Reloadable{LogLevel: *logLevel}
+	if *rulesConfig != "" {
+		live.Rules = &Rules{Path: *rulesConfig}
+		if err := live.Rules.Load(); err != nil {
+			return nil, fmt.Errorf("error loading rules: %w", err)
+		}
+	}
+	if *rateLimit > 0 {
+		live.Limiter = old.Limiter
+		if live.Limiter == nil || live.Limiter.Reports != *rateLimit || live.Limiter.Period != *rateLimitPeriod {
+			live.Limiter = &RateLimiter{Reports: *rateLimit, Period: *rateLimitPeriod}
+		}
+	}
+	if *watchConfig != "" {
+		cfg, err := loadWatchConfig(*watchConfig)
+		if err != nil {
+			return nil, fmt.Errorf("error loading watch config: %w", err)
+		}
+		live.Watch = cfg
+	}
+
+	natsURL := *sinkNATSURL
+	if rl.EmbeddedNATS != "" {
+		natsURL = rl.EmbeddedNATS
+	}
+	live.sinkSettings = strings.Join([]string{*sinkWebhooks, natsURL, *sinkNATSSubject, fmt.Sprint(*sinkMaxRetries)}, "\n")
+	if live.sinkSettings == old.sinkSettings {
+		live.Sinks = old.Sinks
+		return live, nil
+	}
+	if natsURL != "" {
+		nc, err := nats.Connect(natsURL, nats.MaxReconnects(-1))
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to NATS: %w", err)
+		}
+		live.Sinks = append(live.Sinks, NewSinkQueue(&NATSSink{Conn: nc, Subject: *sinkNATSSubject}, *sinkMaxRetries))
+	}
+	for _, url := range splitList(*sinkWebhooks) {
+		live.Sinks = append(live.Sinks, NewSinkQueue(&WebhookSink{URL: url}, *sinkMaxRetries))
+	}
+	return live, nil
+}
+
+// swap puts live in place of old, then closes the sinks of old which are no
+// longer used once their queues have drained.
+func (rl *Reloader) swap(old, live *Reloadable) {
+	rl.Recorder.setLive(live)
+	rl.Watcher.SetConfig(live.Watch)
+	setLogLevel(live.LogLevel)
+	if live.sinkSettings != old.sinkSettings {
+		for _, q := range old.Sinks {
+			go q.Close()
+		}
+	}
+}
+
+// Watch reloads the configuration whenever panopticon receives SIGHUP, and,
+// while --rules-config is set, the rules whenever their file changes, checked
+// every interval.
+func (rl *Reloader) Watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	tick := time.NewTicker(interval)
+	for {
+		select {
+		case <-hup:
+			rl.Reload()
+		case <-tick.C:
+			rules := rl.Recorder.Live().Rules
+			if rules == nil {
+				continue
+			}
+			if err := rules.Load(); err != nil {
+				log.Printf("Error reloading rules, keeping the previous rules: %v", err)
+			}
+		}
+	}
+}
+
+// ServeHTTP reloads the configuration when an admin POSTs to it.
+func (rl *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := rl.Reload(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error_message": err.Error()})
+		return
+	}
+	w.Write([]byte("{}"))
+}
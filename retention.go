@@ -0,0 +1,74 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// A Pruner deletes the reports and events which are older than they are
+// retained for.
+type Pruner struct {
+	DB      *sql.DB
+	Reports time.Duration // 0 to keep reports forever
+	Events  time.Duration // 0 to keep events forever
+}
+
+// Run prunes the database every interval, forever.
+func (p *Pruner) Run(interval time.Duration) {
+	for {
+		if err := p.Prune(time.Now()); err != nil {
+			log.Printf("Error deleting old data: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Prune deletes what was older than it is retained for at now.
+func (p *Pruner) Prune(now time.Time) error {
+	if p.Reports > 0 {
+		cutoff := now.Add(-p.Reports).Unix()
+		for _, table := range []string{"stats", "dendrite_stats", "quarantine"} {
+			if err := p.deleteBefore(table, "local_timestamp", cutoff); err != nil {
+				return err
+			}
+		}
+	}
+	if p.Events > 0 {
+		if err := p.deleteBefore("homeserver_events", "timestamp", now.Add(-p.Events).Unix()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pruner) deleteBefore(table, column string, cutoff int64) error {
+	res, err := p.DB.Exec(rebind(fmt.Sprintf("DELETE FROM %s WHERE %s < ?", table, column)), cutoff)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		logInfof("Deleted %d rows from %s", n, table)
+		rowsPruned.WithLabelValues(table).Add(float64(n))
+	}
+	return nil
+}
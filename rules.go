@@ -0,0 +1,200 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Actions of a Rule
+const (
+	RuleAccept  = "accept"  // record the report as usual
+	RuleReject  = "reject"  // refuse the report
+	RuleExclude = "exclude" // record the report, but leave it out of the aggregates
+	RuleTag     = "tag"     // record the report with a tag, and carry on evaluating
+)
+
+// RulesConfig lists the rules deciding what happens to each report, based on
+// the homeserver it names and the address it was sent from. The first rule
+// which matches a report decides, apart from tag rules, which only add their
+// tag. Reports which no rule decides get the Default action.
+type RulesConfig struct {
+	Default string `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+// Rule matches the reports which meet all of its conditions.
+type Rule struct {
+	Homeserver string `json:"homeserver"` // the normalized name of the homeserver
+	Glob       string `json:"glob"`       // a pattern for the name, as for path.Match
+	Regex      string `json:"regex"`      // a regular expression for the name
+	Network    string `json:"network"`    // a CIDR containing the address the report came from
+	Action     string `json:"action"`
+	Tag        string `json:"tag"` // added to the report by tag rules
+
+	regex   *regexp.Regexp
+	network *net.IPNet
+}
+
+// RuleDecision is the outcome of evaluating the rules for a report.
+type RuleDecision struct {
+	Action string
+	Tags   []string
+}
+
+func loadRulesConfig(path string) (*RulesConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &RulesConfig{Default: RuleAccept}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validateRuleAction(cfg.Default); err != nil || cfg.Default == RuleTag {
+		return nil, fmt.Errorf("%s: invalid default action %q", path, cfg.Default)
+	}
+	for i := range cfg.Rules {
+		if err := cfg.Rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+		}
+	}
+	return cfg, nil
+}
+
+func validateRuleAction(action string) error {
+	switch action {
+	case RuleAccept, RuleReject, RuleExclude, RuleTag:
+		return nil
+	}
+	return fmt.Errorf("invalid action %q", action)
+}
+
+func (r *Rule) compile() error {
+	if err := validateRuleAction(r.Action); err != nil {
+		return err
+	}
+	if r.Action == RuleTag && r.Tag == "" {
+		return fmt.Errorf("tag rules need a tag")
+	}
+	if r.Homeserver == "" && r.Glob == "" && r.Regex == "" && r.Network == "" {
+		return fmt.Errorf("rules need a homeserver, glob, regex or network to match")
+	}
+	if _, err := path.Match(r.Glob, ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %w", r.Glob, err)
+	}
+	var err error
+	if r.Regex != "" {
+		if r.regex, err = regexp.Compile(r.Regex); err != nil {
+			return err
+		}
+	}
+	if r.Network != "" {
+		if _, r.network, err = net.ParseCIDR(r.Network); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Rule) matches(homeserver string, ip net.IP) bool {
+	if r.Homeserver != "" && r.Homeserver != homeserver {
+		return false
+	}
+	if r.Glob != "" {
+		if ok, _ := path.Match(r.Glob, homeserver); !ok {
+			return false
+		}
+	}
+	if r.regex != nil && !r.regex.MatchString(homeserver) {
+		return false
+	}
+	if r.network != nil && (ip == nil || !r.network.Contains(ip)) {
+		return false
+	}
+	return true
+}
+
+func (cfg *RulesConfig) evaluate(homeserver, addr string) RuleDecision {
+	ip := net.ParseIP(addr)
+	var tags []string
+	for i := range cfg.Rules {
+		rule := &cfg.Rules[i]
+		if !rule.matches(homeserver, ip) {
+			continue
+		}
+		if rule.Action == RuleTag {
+			tags = append(tags, rule.Tag)
+			continue
+		}
+		return RuleDecision{Action: rule.Action, Tags: tags}
+	}
+	return RuleDecision{Action: cfg.Default, Tags: tags}
+}
+
+// Rules holds the rules loaded from a file, reloading them whenever the file
+// changes. A nil *Rules accepts every report.
+type Rules struct {
+	Path string
+
+	mu      sync.RWMutex
+	config  *RulesConfig
+	modTime time.Time
+}
+
+// Load reads the rules file if it has changed since it was last read. If
+// the new rules are invalid, the previous rules are kept.
+func (r *Rules) Load() error {
+	info, err := os.Stat(r.Path)
+	if err != nil {
+		return err
+	}
+	r.mu.RLock()
+	unchanged := r.config != nil && info.ModTime().Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cfg, err := loadRulesConfig(r.Path)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.config = cfg
+	r.modTime = info.ModTime()
+	r.mu.Unlock()
+	logInfof("Loaded %d rules from %s", len(cfg.Rules), r.Path)
+	return nil
+}
+
+// Evaluate decides what to do with a report from the given homeserver and
+// client IP address.
+func (r *Rules) Evaluate(homeserver, addr string) RuleDecision {
+	if r == nil {
+		return RuleDecision{Action: RuleAccept}
+	}
+	r.mu.RLock()
+	cfg := r.config
+	r.mu.RUnlock()
+	return cfg.evaluate(homeserver, addr)
+}
@@ -2,36 +2,268 @@
 # Script to read the stats table and aggregate results down to the sums per day
 # The goal of the aggregate datastore is to improve analytics performance.
 
+import argparse
+import json
+import logging
 import pymysql.cursors
 import os
+import re
+import statistics
+import sys
 import time
+import urllib.request
 from dateutil import tz
-from datetime import datetime
+from datetime import datetime, timedelta, tzinfo
+from typing import Dict, List, Optional, Sequence, Tuple
 
 from pymysql import Connection
 
-ONE_DAY = 24 * 60 * 60
+ONE_HOUR = 60 * 60
+ONE_DAY = 24 * ONE_HOUR
 # if the aggregation table isn't populated, this (2015-01-01) is the date that
 # we will start from.
 INITIAL_DAY = 1443657600
+# a homeserver which hasn't reported for this many days is considered to have
+# churned, unless overridden by PANOPTICON_CHURN_DAYS.
+DEFAULT_CHURN_DAYS = 30
+# each run aggregates this many already aggregated days again, to account for
+# late reports, unless overridden by PANOPTICON_RECOMPUTE_DAYS.
+DEFAULT_RECOMPUTE_DAYS = 2
+# the granularities of aggregate_rollups, besides the days of aggregate_stats
+HOUR = 'hour'
+DAY = 'day'
+WEEK = 'week'
+MONTH = 'month'
+ROLLUP_GRANULARITIES = (HOUR, WEEK, MONTH)
+# the tables holding rows for each aggregated day
+DAILY_TABLES = (
+    'aggregate_stats',
+    'aggregate_homeserver_lifecycle',
+    'aggregate_homeserver_events',
+    'aggregate_distributions',
+    'aggregate_size_histogram',
+    'aggregate_breakdowns',
+    'aggregate_carried_forward',
+)
 
 METRIC_COLUMNS = ('total_users', 'total_nonbridged_users', 'total_room_count', 'daily_active_users', 'daily_active_rooms', 'daily_messages', 'daily_sent_messages', 'daily_active_e2ee_rooms', 'daily_e2ee_messages', 'daily_sent_e2ee_messages', 'monthly_active_users', 'r30_users_all', 'r30_users_android', 'r30_users_ios', 'r30_users_electron', 'r30_users_web', 'r30v2_users_all', 'r30v2_users_android', 'r30v2_users_ios', 'r30v2_users_electron', 'r30v2_users_web', 'daily_user_type_native', 'daily_user_type_bridged', 'daily_user_type_guest')
-QUERY_COLUMNS = ','.join(METRIC_COLUMNS + ('homeserver',))
+# the columns of aggregate_stats checked for anomalies
+ANOMALY_COLUMNS = METRIC_COLUMNS + ('daily_active_homeservers',)
+# anomalies are judged against this many preceding days
+ANOMALY_WINDOW_DAYS = 7
+DEFAULT_ANOMALY_MAX_PERCENT_CHANGE = 30.0
+DEFAULT_ANOMALY_MAX_ZSCORE = 4.0
+# the dimensions aggregate_breakdowns can group homeservers by, and the
+# expressions which give their value in the stats and dendrite_stats tables
+DIMENSIONS = {
+    "database_engine": ("database_engine", "database_engine"),
+    "server_software": ("'synapse'", "'dendrite'"),
+    "python_version": ("python_version", "NULL"),
+    "go_version": ("NULL", "goversion"),
+    "goos": ("NULL", "goos"),
+    "goarch": ("NULL", "goarch"),
+    "monolith": ("NULL", "monolith"),
+    "nats_embedded": ("NULL", "nats_embedded"),
+    "log_level": ("log_level", "log_level"),
+}
+# the metrics summed for each value of a dimension, including the number of
+# homeservers with that value
+BREAKDOWN_METRICS = METRIC_COLUMNS + ('homeservers',)
+# the percentiles stored in aggregate_distributions
+PERCENTILES = (50, 90, 99)
+# lower bounds of the buckets of aggregate_size_histogram, by total_users
+SIZE_BUCKETS = (1, 10, 100, 1000, 10000, 100000, 1000000)
+
+logger = logging.getLogger(__name__)
+
+
+class AnomalyRules:
+    """Thresholds beyond which a day's aggregate is reported as an anomaly.
+    A threshold of 0 disables the rule."""
+    def __init__(
+        self,
+        max_percent_change: float = DEFAULT_ANOMALY_MAX_PERCENT_CHANGE,
+        max_zscore: float = DEFAULT_ANOMALY_MAX_ZSCORE,
+    ):
+        self.max_percent_change = max_percent_change
+        self.max_zscore = max_zscore
+
+
+class ReportFilters:
+    """Which reports to leave out of the aggregates, besides those of empty
+    homeservers and those excluded by Panopticon's rules."""
+    def __init__(self, min_trust_score: float = 0, exclude_ownership_mismatch: bool = False):
+        # reports scored below this by Panopticon are left out
+        self.min_trust_score = min_trust_score
+        # leave out homeservers which Panopticon found reporting from an
+        # address their name does not resolve to
+        self.exclude_ownership_mismatch = exclude_ownership_mismatch
+
+    def conditions(self) -> Tuple[str, Tuple]:
+        """The SQL conditions on the stats tables, and their parameters."""
+        sql = "AND COALESCE(trust_score, 1) >= %s"
+        if self.exclude_ownership_mismatch:
+            sql += " AND homeserver NOT IN (SELECT homeserver FROM homeserver_verifications WHERE ip_matches = 0)"
+        return sql, (self.min_trust_score,)
+
+
+class AggregationOptions:
+    """How to aggregate, beyond the sums in aggregate_stats."""
+    def __init__(
+        self,
+        churn_days: int = DEFAULT_CHURN_DAYS,
+        anomaly_rules: Optional[AnomalyRules] = None,
+        alert_webhooks: Sequence[str] = (),
+        breakdown_dimensions: Sequence[str] = tuple(DIMENSIONS),
+        recompute_days: int = DEFAULT_RECOMPUTE_DAYS,
+        carry_forward_days: int = 0,
+        timezone: Optional[tzinfo] = None,
+        rollups: Sequence[str] = (),
+        filters: Optional[ReportFilters] = None,
+    ):
+        self.churn_days = churn_days
+        self.anomaly_rules = anomaly_rules
+        self.alert_webhooks = alert_webhooks
+        self.breakdown_dimensions = breakdown_dimensions
+        self.recompute_days = recompute_days
+        self.carry_forward_days = carry_forward_days
+        # the time zone in which days, weeks and months start
+        self.timezone = timezone or tz.tzutc()
+        self.rollups = rollups
+        self.filters = filters or ReportFilters()
+
+
+def read_config_file(path: Optional[str]) -> Dict[str, Dict[str, object]]:
+    """Reads the TOML config file shared with panopticon, if there is one."""
+    if not path:
+        return {}
+    import tomllib
+    with open(path, "rb") as f:
+        return tomllib.load(f)
+
+
+# the parts of a Go MySQL data source name, user:password@tcp(host:port)/name?params
+MYSQL_DSN = re.compile(
+    r"^(?:(?P<user>[^:@]*)(?::(?P<password>.*))?@)?(?:tcp\((?P<host>[^)]*?)(?::(?P<port>\d+))?\))?/(?P<name>[^?]+)"
+)
+
+
+def parse_mysql_dsn(dsn: str) -> Tuple[str, str, str, int, str]:
+    """Parses the user, password, host, port and database name of the MySQL
+    data source name panopticon connects with."""
+    match = MYSQL_DSN.match(dsn)
+    if match is None:
+        raise ValueError("Cannot parse storage.db, or PANOPTICON_DB, as a MySQL data source name over TCP")
+    return (
+        match["user"] or "",
+        match["password"] or "",
+        match["host"] or "localhost",
+        int(match["port"] or 3306),
+        match["name"],
+    )
+
 
 class Config:
-    def __init__(self):
-        self.db_name = os.environ["PANOPTICON_DB_NAME"]
-        self.db_user = os.environ["PANOPTICON_DB_USER"]
-        self.db_password = os.environ["PANOPTICON_DB_PASSWORD"]
-        self.db_host = os.environ["PANOPTICON_DB_HOST"]
-        self.db_port = int(os.environ["PANOPTICON_DB_PORT"])
-
-    def connect_db(self) -> Connection:
+    """The configuration of the aggregation: the [storage] and [aggregation]
+    sections of the config file named by PANOPTICON_CONFIG, overridden by the
+    PANOPTICON_* environment variables named after their settings, as in
+    panopticon itself."""
+
+    def __init__(self, environ=os.environ):
+        config_file = read_config_file(environ.get("PANOPTICON_CONFIG"))
+
+        def setting(section, key, env, default=None):
+            if environ.get(env):
+                return environ[env]
+            value = config_file.get(section, {}).get(key, default)
+            if value is None:
+                raise ValueError(f"Missing {section}.{key} in the config file, or {env}")
+            return value
+
+        def list_setting(section, key, env, default):
+            value = setting(section, key, env, default)
+            if isinstance(value, str):
+                value = value.split(",")
+            return [item for item in value if item]
+
+        def bool_setting(section, key, env):
+            value = setting(section, key, env, False)
+            if isinstance(value, str):
+                return value.lower() in ("1", "true")
+            return bool(value)
+
+        driver = setting("storage", "driver", "PANOPTICON_DB_DRIVER", "mysql")
+        if driver != "mysql":
+            raise ValueError(f"The aggregation needs a MySQL database, not {driver!r}")
+        # as in panopticon, the separate connection settings are used if the
+        # database name is set, and the data source otherwise
+        dsn = setting("storage", "db", "PANOPTICON_DB", "")
+        if setting("storage", "name", "PANOPTICON_DB_NAME", "") or not dsn:
+            self.db_name = setting("storage", "name", "PANOPTICON_DB_NAME")
+            self.db_user = setting("storage", "user", "PANOPTICON_DB_USER")
+            self.db_password = setting("storage", "password", "PANOPTICON_DB_PASSWORD")
+            self.db_host = setting("storage", "host", "PANOPTICON_DB_HOST", "localhost")
+            self.db_port = int(setting("storage", "port", "PANOPTICON_DB_PORT", 3306))
+        else:
+            self.db_user, self.db_password, self.db_host, self.db_port, self.db_name = parse_mysql_dsn(dsn)
+        # the databases of the tenants, by name, each of which is aggregated
+        # on its own after the default database
+        self.tenants: Dict[str, str] = {}
+        tenants_config = setting("storage", "tenants_config", "PANOPTICON_TENANTS_CONFIG", "")
+        if tenants_config:
+            with open(tenants_config) as f:
+                for tenant in json.load(f).get("tenants", []):
+                    self.tenants[tenant["name"]] = tenant["database"]
+
+        breakdown_dimensions = list_setting(
+            "aggregation", "breakdown_dimensions", "PANOPTICON_BREAKDOWN_DIMENSIONS", list(DIMENSIONS)
+        )
+        for dimension in breakdown_dimensions:
+            if dimension not in DIMENSIONS:
+                raise ValueError(f"Unknown breakdown dimension {dimension!r}")
+        rollups = list_setting("aggregation", "rollups", "PANOPTICON_ROLLUPS", [])
+        for granularity in rollups:
+            if granularity not in ROLLUP_GRANULARITIES:
+                raise ValueError(f"Unknown rollup granularity {granularity!r}")
+        timezone_name = setting("aggregation", "timezone", "PANOPTICON_TIMEZONE", "UTC")
+        timezone = tz.gettz(timezone_name)
+        if timezone is None:
+            raise ValueError(f"Unknown time zone {timezone_name!r}")
+        self.options = AggregationOptions(
+            churn_days=int(setting("aggregation", "churn_days", "PANOPTICON_CHURN_DAYS", DEFAULT_CHURN_DAYS)),
+            anomaly_rules=AnomalyRules(
+                float(setting(
+                    "aggregation", "anomaly_max_percent_change", "PANOPTICON_ANOMALY_MAX_PERCENT_CHANGE",
+                    DEFAULT_ANOMALY_MAX_PERCENT_CHANGE,
+                )),
+                float(setting(
+                    "aggregation", "anomaly_max_zscore", "PANOPTICON_ANOMALY_MAX_ZSCORE", DEFAULT_ANOMALY_MAX_ZSCORE
+                )),
+            ),
+            alert_webhooks=list_setting("aggregation", "alert_webhooks", "PANOPTICON_ALERT_WEBHOOKS", []),
+            breakdown_dimensions=breakdown_dimensions,
+            recompute_days=int(setting(
+                "aggregation", "recompute_days", "PANOPTICON_RECOMPUTE_DAYS", DEFAULT_RECOMPUTE_DAYS
+            )),
+            carry_forward_days=int(setting("aggregation", "carry_forward_days", "PANOPTICON_CARRY_FORWARD_DAYS", 0)),
+            timezone=timezone,
+            rollups=rollups,
+            filters=ReportFilters(
+                min_trust_score=float(setting("aggregation", "min_trust_score", "PANOPTICON_MIN_TRUST_SCORE", 0)),
+                exclude_ownership_mismatch=bool_setting(
+                    "aggregation", "exclude_ownership_mismatch", "PANOPTICON_EXCLUDE_OWNERSHIP_MISMATCH"
+                ),
+            ),
+        )
+
+    def connect_db(self, tenant: Optional[str] = None) -> Connection:
+        """Connects to the database of the given tenant, or by default to the
+        default database."""
         return pymysql.connect(
             host=self.db_host,
             user=self.db_user,
             passwd=self.db_password,
-            db=self.db_name,
+            db=self.tenants[tenant] if tenant else self.db_name,
             port=self.db_port,
             ssl={'ssl': {}}
         )
@@ -75,21 +307,272 @@ def set_up_aggregate_stats_table(db: Connection):
     create_table(db, SCHEMA)
 
 
+def set_up_aggregate_lifecycle_table(db: Connection):
+    SCHEMA = """
+        CREATE TABLE IF NOT EXISTS `aggregate_homeserver_lifecycle` (
+            `day` bigint(20) NOT NULL,
+            `new_homeservers` bigint(20) DEFAULT NULL,
+            `returning_homeservers` bigint(20) DEFAULT NULL,
+            `churned_homeservers` bigint(20) DEFAULT NULL,
+            PRIMARY KEY (`day`)
+        ) ENGINE=InnoDB DEFAULT CHARSET=latin1
+    """
+
+    create_table(db, SCHEMA)
+
+
+def set_up_aggregate_events_table(db: Connection):
+    SCHEMA = """
+        CREATE TABLE IF NOT EXISTS `aggregate_homeserver_events` (
+            `day` bigint(20) NOT NULL,
+            `event_type` varchar(32) NOT NULL,
+            `count` bigint(20) DEFAULT NULL,
+            PRIMARY KEY (`day`, `event_type`)
+        ) ENGINE=InnoDB DEFAULT CHARSET=latin1
+    """
+
+    create_table(db, SCHEMA)
+
+
+def set_up_aggregate_alerts_table(db: Connection):
+    SCHEMA = """
+        CREATE TABLE IF NOT EXISTS `aggregate_alerts` (
+            `id` bigint(20) NOT NULL AUTO_INCREMENT,
+            `day` bigint(20) NOT NULL,
+            `metric` varchar(64) NOT NULL,
+            `rule` varchar(32) NOT NULL,
+            `value` double DEFAULT NULL,
+            `baseline` double DEFAULT NULL,
+            `score` double DEFAULT NULL,
+            PRIMARY KEY (`id`),
+            KEY `day` (`day`)
+        ) ENGINE=InnoDB DEFAULT CHARSET=latin1
+    """
+
+    create_table(db, SCHEMA)
+
+
+def set_up_aggregate_distribution_tables(db: Connection):
+    DISTRIBUTIONS_SCHEMA = """
+        CREATE TABLE IF NOT EXISTS `aggregate_distributions` (
+            `day` bigint(20) NOT NULL,
+            `metric` varchar(64) NOT NULL,
+            `count` bigint(20) DEFAULT NULL,
+            `p50` bigint(20) DEFAULT NULL,
+            `p90` bigint(20) DEFAULT NULL,
+            `p99` bigint(20) DEFAULT NULL,
+            `max` bigint(20) DEFAULT NULL,
+            PRIMARY KEY (`day`, `metric`)
+        ) ENGINE=InnoDB DEFAULT CHARSET=latin1
+    """
+    HISTOGRAM_SCHEMA = """
+        CREATE TABLE IF NOT EXISTS `aggregate_size_histogram` (
+            `day` bigint(20) NOT NULL,
+            `bucket_min` bigint(20) NOT NULL,
+            `bucket_max` bigint(20) DEFAULT NULL,
+            `homeservers` bigint(20) DEFAULT NULL,
+            `total_users` bigint(20) DEFAULT NULL,
+            PRIMARY KEY (`day`, `bucket_min`)
+        ) ENGINE=InnoDB DEFAULT CHARSET=latin1
+    """
+
+    create_table(db, DISTRIBUTIONS_SCHEMA)
+    create_table(db, HISTOGRAM_SCHEMA)
+
+
+def set_up_aggregate_breakdowns_table(db: Connection):
+    SCHEMA = """
+        CREATE TABLE IF NOT EXISTS `aggregate_breakdowns` (
+            `day` bigint(20) NOT NULL,
+            `dimension` varchar(64) NOT NULL,
+            `dimension_value` varchar(255) NOT NULL,
+            `metric` varchar(64) NOT NULL,
+            `value` bigint(20) DEFAULT NULL,
+            PRIMARY KEY (`day`, `dimension`, `dimension_value`, `metric`)
+        ) ENGINE=InnoDB DEFAULT CHARSET=latin1
+    """
+
+    create_table(db, SCHEMA)
+
+
+def set_up_aggregate_carried_forward_table(db: Connection):
+    SCHEMA = """
+        CREATE TABLE IF NOT EXISTS `aggregate_carried_forward` (
+            `day` bigint(20) NOT NULL,
+            `homeserver` varchar(256) NOT NULL,
+            `local_timestamp` bigint(20) DEFAULT NULL,
+            PRIMARY KEY (`day`, `homeserver`)
+        ) ENGINE=InnoDB DEFAULT CHARSET=latin1
+    """
+
+    create_table(db, SCHEMA)
+
+
+def set_up_aggregate_rollups_table(db: Connection):
+    metric_columns = "".join(f"`{metric}` bigint(20) DEFAULT NULL," for metric in METRIC_COLUMNS)
+    SCHEMA = f"""
+        CREATE TABLE IF NOT EXISTS `aggregate_rollups` (
+            `granularity` varchar(8) NOT NULL,
+            `period_start` bigint(20) NOT NULL,
+            `period_end` bigint(20) NOT NULL,
+            {metric_columns}
+            `active_homeservers` bigint(20) DEFAULT NULL,
+            PRIMARY KEY (`granularity`, `period_start`)
+        ) ENGINE=InnoDB DEFAULT CHARSET=latin1
+    """
+
+    create_table(db, SCHEMA)
+
+
+def set_up_recompute_requests_table(db: Connection):
+    # also created by panopticon, which adds requests to it
+    SCHEMA = """
+        CREATE TABLE IF NOT EXISTS `recompute_requests` (
+            `id` int(11) NOT NULL AUTO_INCREMENT,
+            `from_timestamp` bigint(20) DEFAULT NULL,
+            `to_timestamp` bigint(20) DEFAULT NULL,
+            `requested_at` bigint(20) DEFAULT NULL,
+            `reason` text,
+            `completed_at` bigint(20) DEFAULT NULL,
+            PRIMARY KEY (`id`)
+        ) ENGINE=InnoDB DEFAULT CHARSET=latin1
+    """
+
+    create_table(db, SCHEMA)
+
+
+def set_up_tables(db: Connection):
+    set_up_aggregate_stats_table(db)
+    set_up_aggregate_lifecycle_table(db)
+    set_up_aggregate_events_table(db)
+    set_up_aggregate_alerts_table(db)
+    set_up_aggregate_distribution_tables(db)
+    set_up_aggregate_breakdowns_table(db)
+    set_up_aggregate_carried_forward_table(db)
+    set_up_aggregate_rollups_table(db)
+    set_up_recompute_requests_table(db)
+
+
+def local_timestamp(year: int, month: int, day: int, timezone: tzinfo) -> int:
+    """The timestamp of midnight at the start of the given date in the given
+    time zone, or of the first time after it where midnight is skipped."""
+    return int(tz.resolve_imaginary(datetime(year, month, day, tzinfo=timezone)).timestamp())
+
+
+def period_start(timestamp: int, granularity: str, timezone: tzinfo) -> int:
+    """The start of the hour, day, ISO week or calendar month containing the
+    given timestamp, in the given time zone."""
+    local = datetime.fromtimestamp(timestamp, timezone)
+    if granularity == HOUR:
+        return timestamp - (timestamp + int(local.utcoffset().total_seconds())) % ONE_HOUR
+    date = local.date()
+    if granularity == WEEK:
+        date -= timedelta(days=date.weekday())
+    elif granularity == MONTH:
+        date = date.replace(day=1)
+    return local_timestamp(date.year, date.month, date.day, timezone)
+
+
+def period_end(start: int, granularity: str, timezone: tzinfo) -> int:
+    """The start of the period following the one starting at start. Days
+    are not always ONE_DAY long, because of daylight saving time."""
+    if granularity == HOUR:
+        return start + ONE_HOUR
+    date = datetime.fromtimestamp(start, timezone).date()
+    if granularity == MONTH:
+        return local_timestamp(date.year + date.month // 12, date.month % 12 + 1, 1, timezone)
+    date += timedelta(days=7 if granularity == WEEK else 1)
+    return local_timestamp(date.year, date.month, date.day, timezone)
+
+
+def parse_day(value: str, timezone: tzinfo) -> int:
+    """Parses a YYYY-MM-DD date into the timestamp of the start of that day."""
+    date = datetime.strptime(value, "%Y-%m-%d")
+    return local_timestamp(date.year, date.month, date.day, timezone)
+
+
 def main():
+    parser = argparse.ArgumentParser(description="Aggregates the stats recorded by Panopticon per day.")
+    subparsers = parser.add_subparsers(dest="command")
+    recompute = subparsers.add_parser("recompute", help="aggregate a range of days again, then exit")
+    recompute.add_argument("--from", dest="from_day", required=True,
+                           help="the first day to aggregate, as YYYY-MM-DD")
+    recompute.add_argument("--to", dest="to_day", required=True,
+                           help="the day to stop before, as YYYY-MM-DD")
+    recompute.add_argument("--tenant",
+                           help="only aggregate the days of this tenant, rather than of every tenant")
+    args = parser.parse_args()
+
+    logging.basicConfig(level=logging.INFO)
     configuration = Config()
+    options = configuration.options
 
-    db = configuration.connect_db()
+    # tenants are aggregated independently, each in its own database, so
+    # that one whose database fails does not hold up the others
+    tenants = [None] + list(configuration.tenants)
+    if args.command == "recompute" and args.tenant:
+        if args.tenant not in configuration.tenants:
+            parser.error(f"unknown tenant {args.tenant!r}")
+        tenants = [args.tenant]
+    dbs: Dict[Optional[str], Connection] = {}
 
-    set_up_aggregate_stats_table(db)
+    def connect(tenant: Optional[str]) -> Connection:
+        if tenant not in dbs:
+            db = configuration.connect_db(tenant)
+            set_up_tables(db)
+            dbs[tenant] = db
+        return dbs[tenant]
+
+    def failed(tenant: Optional[str]):
+        logger.exception("Error aggregating %s", f"tenant {tenant}" if tenant else "the default database")
+        # connect again the next time, in case the connection was lost
+        db = dbs.pop(tenant, None)
+        if db is not None:
+            try:
+                db.close()
+            except Exception:
+                pass
+
+    if args.command == "recompute":
+        ok = True
+        for tenant in tenants:
+            try:
+                aggregate_range(
+                    connect(tenant),
+                    parse_day(args.from_day, options.timezone),
+                    parse_day(args.to_day, options.timezone),
+                    options,
+                )
+            except Exception:
+                failed(tenant)
+                ok = False
+        sys.exit(0 if ok else 1)
 
+    # hourly rollups are kept up to date by waking up every hour, but days
+    # are only aggregated once they are over
+    last_today: Dict[Optional[str], int] = {}
     while True:
-        now = datetime.utcnow().date()
-        today = int(datetime(now.year, now.month, now.day, tzinfo=tz.tzutc()).strftime('%s'))
-        aggregate_until_today(db, today)
-        time.sleep(ONE_DAY)
+        now = int(time.time())
+        today = period_start(now, DAY, options.timezone)
+        for tenant in tenants:
+            try:
+                db = connect(tenant)
+                if today != last_today.get(tenant):
+                    aggregate_until_today(db, today, options)
+                    last_today[tenant] = today
+                aggregate_requested(db, today, options)
+                aggregate_rollups_until(db, now, options)
+            except Exception:
+                failed(tenant)
+        time.sleep(ONE_HOUR if HOUR in options.rollups else ONE_DAY)
 
 
-def aggregate_until_today(db: Connection, today: int):
+def aggregate_until_today(db: Connection, today: int, options: Optional[AggregationOptions] = None):
+    """Aggregates every day since the last one in aggregate_stats, up to but
+    not including today. The last options.recompute_days days which were
+    already aggregated are aggregated again, to take late reports into
+    account."""
+    options = options or AggregationOptions()
     with db.cursor() as cursor:
         start_date_query = """
             SELECT day from aggregate_stats
@@ -104,102 +587,471 @@ def aggregate_until_today(db: Connection, today: int):
             # which is when the stats table is populated from.
             last_day_in_db = INITIAL_DAY
 
-    processing_day = last_day_in_db + ONE_DAY
+    # days are measured from their middle, which is always within the right
+    # day despite daylight saving time
+    processing_day = period_start(
+        max(INITIAL_DAY + ONE_DAY, last_day_in_db - (options.recompute_days - 1) * ONE_DAY) + ONE_DAY // 2,
+        DAY,
+        options.timezone,
+    )
     while processing_day < today:
+        # anomalies have already been checked for days being recomputed
+        aggregate_day(db, processing_day, options, check_anomalies=processing_day > last_day_in_db)
+        processing_day = period_end(processing_day, DAY, options.timezone)
+
+
+def aggregate_range(db: Connection, from_day: int, to_day: int, options: Optional[AggregationOptions] = None):
+    """Aggregates the days from from_day up to but not including to_day,
+    replacing anything previously aggregated for them, along with the
+    rollups of any period overlapping them."""
+    options = options or AggregationOptions()
+    day = from_day
+    while day < to_day:
+        logger.info("Aggregating %s", datetime.fromtimestamp(day, options.timezone).date())
+        aggregate_day(db, day, options, check_anomalies=False)
+        day = period_end(day, DAY, options.timezone)
+
+    for granularity in options.rollups:
+        start = period_start(from_day, granularity, options.timezone)
+        while start < to_day:
+            start = aggregate_rollup(db, granularity, start, options)
+
+
+def aggregate_requested(db: Connection, today: int, options: Optional[AggregationOptions] = None):
+    """Aggregates again the days asked for in recompute_requests, such as
+    those whose reports from a homeserver were erased, up to but not
+    including today."""
+    options = options or AggregationOptions()
+    with db.cursor() as cursor:
+        cursor.execute(
+            "SELECT id, from_timestamp, to_timestamp FROM recompute_requests WHERE completed_at IS NULL ORDER BY id"
+        )
+        requests = cursor.fetchall()
+
+    for request_id, from_timestamp, to_timestamp in requests:
+        # a homeserver's last report is carried forward, and it is counted
+        # as churned, for some days after it was received
+        last_affected = to_timestamp + max(options.churn_days, options.carry_forward_days) * ONE_DAY
+        from_day = period_start(from_timestamp, DAY, options.timezone)
+        to_day = min(today, period_end(period_start(last_affected, DAY, options.timezone), DAY, options.timezone))
+        if from_day < to_day:
+            aggregate_range(db, from_day, to_day, options)
+        with db.cursor() as cursor:
+            cursor.execute(
+                "UPDATE recompute_requests SET completed_at = %s WHERE id = %s", (int(time.time()), request_id)
+            )
+        db.commit()
+
+
+def aggregate_rollups_until(db: Connection, now: int, options: AggregationOptions):
+    """Aggregates every complete period of each of options.rollups since the
+    last one in aggregate_rollups. As with days, the periods in the last
+    options.recompute_days days are aggregated again."""
+    for granularity in options.rollups:
+        with db.cursor() as cursor:
+            cursor.execute(
+                "SELECT MAX(period_start) FROM aggregate_rollups WHERE granularity = %s", (granularity,)
+            )
+            last_start = cursor.fetchone()[0]
+
+        if last_start is None:
+            # nothing was rolled up yet, so start from the earliest report
+            # rather than from INITIAL_DAY, which would be a lot of hours
+            first_report = earliest_report(db)
+            if first_report is None:
+                continue
+            start = period_start(first_report, granularity, options.timezone)
+        else:
+            start = period_start(
+                min(last_start, now - options.recompute_days * ONE_DAY), granularity, options.timezone
+            )
+        while period_end(start, granularity, options.timezone) <= now:
+            start = aggregate_rollup(db, granularity, start, options)
+
+
+def earliest_report(db: Connection) -> Optional[int]:
+    """The local_timestamp of the earliest report in either stats table, or
+    None if there are none."""
+    with db.cursor() as cursor:
+        cursor.execute(
+            """
+            SELECT MIN(t) FROM (
+                SELECT MIN(local_timestamp) AS t FROM stats
+                UNION ALL
+                SELECT MIN(local_timestamp) FROM dendrite_stats
+            ) earliest
+            """
+        )
+        return cursor.fetchone()[0]
+
+
+def aggregate_rollup(db: Connection, granularity: str, start: int, options: AggregationOptions) -> int:
+    """Sums the metrics of the latest report in the period from each
+    homeserver, replacing any previous rollup of the period, and returns the
+    end of the period. active_homeservers counts every homeserver which
+    reported at any time in the period, rather than on a given day."""
+    end = period_end(start, granularity, options.timezone)
+    with db.cursor() as cursor:
+        reports = latest_reports(cursor, start, end, filters=options.filters)
+        totals = []
+        for metric in METRIC_COLUMNS:
+            values = [int(report[metric]) for report in reports if report[metric] is not None]
+            totals.append(sum(values) if values else None)
+
+        cursor.execute(
+            "DELETE FROM aggregate_rollups WHERE granularity = %s AND period_start = %s", (granularity, start)
+        )
+        columns = ", ".join(METRIC_COLUMNS)
+        placeholders = ", ".join(["%s"] * len(METRIC_COLUMNS))
+        cursor.execute(
+            f"""
+            INSERT INTO aggregate_rollups (granularity, period_start, period_end, {columns}, active_homeservers)
+            VALUES (%s, %s, %s, {placeholders}, %s)
+            """,
+            [granularity, start, end] + totals + [len({report["homeserver"] for report in reports})],
+        )
+    db.commit()
+    return end
+
+
+def aggregate_day(db: Connection, day: int, options: AggregationOptions, check_anomalies: bool = True):
+    """Aggregates a single day into every aggregate table. Anything already
+    aggregated for the day is replaced within the same transaction, so
+    aggregating a day again is safe."""
+    with db.cursor() as cursor:
+        for table in DAILY_TABLES:
+            cursor.execute(f"DELETE FROM {table} WHERE day = %s", (day,))
+
+        end = period_end(day, DAY, options.timezone)
+        reports = latest_reports(cursor, day, end, options.breakdown_dimensions, options.filters)
+        carried = carry_forward(cursor, day, reports, options)
+
+        aggregate_sums(cursor, day, reports, carried)
+        aggregate_lifecycle(cursor, day, end, options.churn_days)
+        aggregate_events(cursor, day, end)
+        aggregate_distributions(cursor, day, reports + carried)
+        aggregate_breakdowns(cursor, day, reports + carried, options.breakdown_dimensions)
+    db.commit()
+
+    if check_anomalies and options.anomaly_rules is not None:
         with db.cursor() as cursor:
-            # Need to filter on "AND total_users > 0" since some installs
-            # run with a standby unused server with an empty db. This means
-            # that picking a recent entry for a given server is likely to
-            # under report. Filtering on total_users removes the standbys.
-            # It also filters out genuinely unused servers, but the value of
-            # aggregating these servers is limited.
-            query = f"""
-                SELECT
-                    SUM(total_users) as 'total_users',
-                    SUM(total_nonbridged_users) as 'total_nonbridged_users',
-                    SUM(total_room_count) as 'total_room_count',
-                    SUM(daily_active_users) as 'daily_active_users',
-                    SUM(daily_active_rooms) as 'daily_active_rooms',
-                    SUM(daily_messages) as 'daily_messages',
-                    SUM(daily_sent_messages) as 'daily_sent_messages',
-                    SUM(daily_active_e2ee_rooms) as 'daily_active_e2ee_rooms',
-                    SUM(daily_e2ee_messages) as 'daily_e2ee_messages',
-                    SUM(daily_sent_e2ee_messages) as 'daily_sent_e2ee_messages',
-                    SUM(monthly_active_users) as 'monthly_active_users',
-                    SUM(r30_users_all) as 'r30_users_all',
-                    SUM(r30_users_android) as 'r30_users_android',
-                    SUM(r30_users_ios) as 'r30_users_ios',
-                    SUM(r30_users_electron) as 'r30_users_electron',
-                    SUM(r30_users_web) as 'r30_users_web',
-                    SUM(r30v2_users_all) as 'r30v2_users_all',
-                    SUM(r30v2_users_android) as 'r30v2_users_android',
-                    SUM(r30v2_users_ios) as 'r30v2_users_ios',
-                    SUM(r30v2_users_electron) as 'r30v2_users_electron',
-                    SUM(r30v2_users_web) as 'r30v2_users_web',
-                    SUM(daily_user_type_native) as 'daily_user_type_native',
-                    SUM(daily_user_type_bridged) as 'daily_user_type_bridged',
-                    SUM(daily_user_type_guest) as 'daily_user_type_guest',
-                    COUNT(homeserver) as 'homeserver'
-                FROM (
-                    SELECT {QUERY_COLUMNS}, MAX(local_timestamp)
-                    FROM stats
-                    WHERE local_timestamp >= %s and local_timestamp < %s
-                    AND total_users > 0
-                    GROUP BY homeserver
+            alerts = detect_anomalies(cursor, day, options.anomaly_rules)
+            record_alerts(cursor, alerts)
+        db.commit()
+        send_alerts(alerts, options.alert_webhooks)
+
+
+def aggregate_sums(cursor, day: int, reports: Sequence[Dict], carried: Sequence[Dict] = ()):
+    """Sums the metrics of the latest report from each homeserver on the day,
+    as fetched by latest_reports, plus those of reports carried forward from
+    earlier days. Only homeservers which reported on the day count towards
+    daily_active_homeservers."""
+    totals = []
+    for metric in METRIC_COLUMNS:
+        values = [int(report[metric]) for report in list(reports) + list(carried) if report[metric] is not None]
+        totals.append(sum(values) if values else None)
+
+    columns = ", ".join(METRIC_COLUMNS)
+    placeholders = ", ".join(["%s"] * len(METRIC_COLUMNS))
+    cursor.execute(
+        f"""
+        INSERT INTO aggregate_stats (day, {columns}, daily_active_homeservers, server_context)
+        VALUES (%s, {placeholders}, %s, %s)
+        """,
+        [day] + totals + [len(reports), None],
+    )
+
+
+def aggregate_lifecycle(cursor, day: int, end: int, churn_days: int):
+    """Counts the homeservers which were first seen between day and end,
+    those which reported again, and those which have just gone `churn_days`
+    without reporting.
+
+    Churn is based on the reports received up to end, so aggregating a day
+    again gives the same count whatever homeservers reported later."""
+    churn_start = day - churn_days * ONE_DAY
+    churn_end = end - churn_days * ONE_DAY
+    query = """
+        SELECT
+            (
+                SELECT COUNT(*) FROM homeservers
+                WHERE first_seen >= %s AND first_seen < %s
+            ),
+            (
+                SELECT COUNT(*) FROM homeservers h
+                WHERE h.first_seen < %s AND h.homeserver IN (
+                    SELECT homeserver FROM stats
+                    WHERE local_timestamp >= %s AND local_timestamp < %s
                     UNION
-                    SELECT {QUERY_COLUMNS}, MAX(local_timestamp)
-                    FROM dendrite_stats
-                    WHERE local_timestamp >= %s and local_timestamp < %s
-                    AND total_users > 0
-                    GROUP BY homeserver
-                ) as s;
+                    SELECT homeserver FROM dendrite_stats
+                    WHERE local_timestamp >= %s AND local_timestamp < %s
+                )
+            ),
+            (
+                SELECT COUNT(DISTINCT homeserver) FROM (
+                    SELECT homeserver FROM stats
+                    WHERE local_timestamp >= %s AND local_timestamp < %s
+                    UNION ALL
+                    SELECT homeserver FROM dendrite_stats
+                    WHERE local_timestamp >= %s AND local_timestamp < %s
+                ) churning
+                WHERE homeserver NOT IN (
+                    SELECT homeserver FROM stats
+                    WHERE local_timestamp >= %s AND local_timestamp < %s
+                    UNION
+                    SELECT homeserver FROM dendrite_stats
+                    WHERE local_timestamp >= %s AND local_timestamp < %s
+                )
+            )
+    """
+    cursor.execute(query, (
+        day, end,
+        day, day, end, day, end,
+        churn_start, churn_end, churn_start, churn_end,
+        churn_end, end, churn_end, end,
+    ))
+    new, returning, churned = cursor.fetchone()
+
+    cursor.execute(
+        """
+        INSERT INTO aggregate_homeserver_lifecycle
+        (day, new_homeservers, returning_homeservers, churned_homeservers)
+        VALUES (%s, %s, %s, %s)
+        """,
+        (day, new, returning, churned),
+    )
+
+
+def aggregate_events(cursor, day: int, end: int):
+    """Counts the restarts, upgrades and other homeserver events recorded by
+    Panopticon between day and end, by type of event."""
+    cursor.execute(
+        """
+        INSERT INTO aggregate_homeserver_events (day, event_type, count)
+        SELECT %s, event_type, COUNT(*)
+        FROM homeserver_events
+        WHERE timestamp >= %s AND timestamp < %s
+        GROUP BY event_type
+        """,
+        (day, day, end),
+    )
+
+
+def latest_reports(
+    cursor, start: int, end: int, dimensions: Sequence[str] = (), filters: Optional[ReportFilters] = None
+) -> List[Dict]:
+    """Fetches the latest report from each homeserver between start and end,
+    from both the Synapse and Dendrite tables. The values of the given
+    DIMENSIONS are included. Every aggregate is computed from these reports.
+
+    Each homeserver has a single report, even if it sent several at the same
+    time or reported as both Synapse and Dendrite."""
+    # Need to filter on "AND total_users > 0" since some installs
+    # run with a standby unused server with an empty db. This means
+    # that picking a recent entry for a given server is likely to
+    # under report. Filtering on total_users removes the standbys.
+    # It also filters out genuinely unused servers, but the value of
+    # aggregating these servers is limited.
+    # Reports excluded by Panopticon's rules are also left out, as are any
+    # left out by the filters.
+    subquery = """
+        SELECT {columns}{dimensions} FROM {table} s
+        JOIN (
+            SELECT homeserver, MAX(local_timestamp) AS local_timestamp
+            FROM {table}
+            WHERE local_timestamp >= %s AND local_timestamp < %s
+            AND total_users > 0
+            AND excluded IS NULL
+            {conditions}
+            GROUP BY homeserver
+        ) latest USING (homeserver, local_timestamp)
+    """
+    names = METRIC_COLUMNS + ('homeserver', 'local_timestamp', 'id') + tuple(dimensions)
+    columns = ", ".join(f"s.{column}" for column in METRIC_COLUMNS + ('homeserver', 'local_timestamp', 'id'))
+    conditions, params = (filters or ReportFilters()).conditions()
+    query = " UNION ALL ".join(
+        subquery.format(
+            columns=columns,
+            dimensions="".join(f", {DIMENSIONS[dimension][i]}" for dimension in dimensions),
+            table=table,
+            conditions=conditions,
+        )
+        for i, table in enumerate(("stats", "dendrite_stats"))
+    )
+    cursor.execute(query, (start, end) + params + (start, end) + params)
+    # reports sent at the same time are told apart by the order they were
+    # stored in
+    def order(report: Dict) -> Tuple[int, int]:
+        return report["local_timestamp"], report["id"]
+
+    latest = {}
+    for row in cursor.fetchall():
+        report = dict(zip(names, row))
+        previous = latest.get(report["homeserver"])
+        if previous is None or order(report) > order(previous):
+            latest[report["homeserver"]] = report
+    for report in latest.values():
+        del report["id"]
+    return list(latest.values())
+
+
+def carry_forward(cursor, day: int, reports: List[Dict], options: AggregationOptions) -> List[Dict]:
+    """Finds the latest report of each homeserver which reported in the
+    options.carry_forward_days before the given day, but not on the day
+    itself, so that a missed report does not cause a dip in the aggregates.
+    The carried homeservers are recorded in aggregate_carried_forward."""
+    if not options.carry_forward_days:
+        return []
+
+    reported = {report["homeserver"] for report in reports}
+    latest: Dict[str, Dict] = {}
+    for report in latest_reports(
+        cursor,
+        day - options.carry_forward_days * ONE_DAY,
+        day,
+        options.breakdown_dimensions,
+        options.filters,
+    ):
+        previous = latest.get(report["homeserver"])
+        if previous is None or report["local_timestamp"] > previous["local_timestamp"]:
+            latest[report["homeserver"]] = report
+    carried = [report for homeserver, report in latest.items() if homeserver not in reported]
+    cursor.executemany(
+        """
+        INSERT INTO aggregate_carried_forward (day, homeserver, local_timestamp)
+        VALUES (%s, %s, %s)
+        """,
+        [(day, report["homeserver"], report["local_timestamp"]) for report in carried],
+    )
+    return carried
+
+
+def percentile(values: List[int], p: int) -> int:
+    """The p-th percentile of sorted values, by the nearest-rank method."""
+    rank = max(1, -(-p * len(values) // 100))
+    return values[rank - 1]
+
+
+def aggregate_distributions(cursor, day: int, reports: List[Dict]):
+    """Stores the percentiles and maximum of each metric across the reports
+    of each homeserver, and how many homeservers there are of each size by
+    total_users."""
+    for metric in METRIC_COLUMNS:
+        values = sorted(int(report[metric]) for report in reports if report[metric] is not None)
+        if not values:
+            continue
+        cursor.execute(
+            """
+            INSERT INTO aggregate_distributions (day, metric, count, p50, p90, p99, max)
+            VALUES (%s, %s, %s, %s, %s, %s, %s)
+            """,
+            (day, metric, len(values)) + tuple(percentile(values, p) for p in PERCENTILES) + (values[-1],),
+        )
+
+    bounds = list(zip(SIZE_BUCKETS, SIZE_BUCKETS[1:] + (None,)))
+    for bucket_min, bucket_max in bounds:
+        sizes = [
+            int(report["total_users"]) for report in reports
+            if report["total_users"] >= bucket_min and (bucket_max is None or report["total_users"] < bucket_max)
+        ]
+        cursor.execute(
+            """
+            INSERT INTO aggregate_size_histogram (day, bucket_min, bucket_max, homeservers, total_users)
+            VALUES (%s, %s, %s, %s, %s)
+            """,
+            (day, bucket_min, bucket_max, len(sizes), sum(sizes)),
+        )
+
+
+def aggregate_breakdowns(cursor, day: int, reports: List[Dict], dimensions: Sequence[str]):
+    """Sums the metrics of homeservers grouped by each of the given
+    dimensions in turn, e.g. the total users of homeservers using each
+    database engine. Homeservers which did not report a dimension are counted
+    under "unknown"."""
+    for dimension in dimensions:
+        sums: Dict[str, Dict[str, int]] = {}
+        for report in reports:
+            value = report[dimension]
+            value = "unknown" if value is None or value == "" else str(value)
+            totals = sums.setdefault(value, dict.fromkeys(BREAKDOWN_METRICS, 0))
+            totals["homeservers"] += 1
+            for metric in METRIC_COLUMNS:
+                if report[metric] is not None:
+                    totals[metric] += int(report[metric])
+
+        for value, totals in sums.items():
+            cursor.executemany(
+                """
+                INSERT INTO aggregate_breakdowns (day, dimension, dimension_value, metric, value)
+                VALUES (%s, %s, %s, %s, %s)
+                """,
+                [(day, dimension, value, metric, total) for metric, total in totals.items()],
+            )
+
+
+def detect_anomalies(cursor, day: int, rules: AnomalyRules) -> List[Dict]:
+    """Compares each column of the given day's aggregate with the preceding
+    ANOMALY_WINDOW_DAYS days, returning an alert for every rule it breaks.
+    Columns without a full window of history are not checked."""
+    columns = ", ".join(ANOMALY_COLUMNS)
+    cursor.execute(
+        f"SELECT day, {columns} FROM aggregate_stats WHERE day >= %s AND day <= %s ORDER BY day",
+        # half a day early, in case daylight saving time made any day shorter
+        (day - ANOMALY_WINDOW_DAYS * ONE_DAY - ONE_DAY // 2, day),
+    )
+    rows = cursor.fetchall()
+    if len(rows) != ANOMALY_WINDOW_DAYS + 1 or rows[-1][0] != day:
+        return []
+
+    alerts = []
+    for i, metric in enumerate(ANOMALY_COLUMNS, start=1):
+        value = rows[-1][i]
+        history = [row[i] for row in rows[:-1] if row[i] is not None]
+        if value is None or len(history) != ANOMALY_WINDOW_DAYS:
+            continue
+
+        median = statistics.median(history)
+        if rules.max_percent_change and median != 0:
+            change = (value - median) / median * 100
+            if abs(change) > rules.max_percent_change:
+                alerts.append(dict(day=day, metric=metric, rule="percent_change",
+                                   value=float(value), baseline=float(median), score=change))
+
+        mean = statistics.mean(history)
+        stdev = statistics.pstdev(history)
+        if rules.max_zscore and stdev != 0:
+            zscore = (value - mean) / stdev
+            if abs(zscore) > rules.max_zscore:
+                alerts.append(dict(day=day, metric=metric, rule="zscore",
+                                   value=float(value), baseline=float(mean), score=zscore))
+    return alerts
+
+
+def record_alerts(cursor, alerts: List[Dict]):
+    for alert in alerts:
+        cursor.execute(
             """
+            INSERT INTO aggregate_alerts (day, metric, rule, value, baseline, score)
+            VALUES (%(day)s, %(metric)s, %(rule)s, %(value)s, %(baseline)s, %(score)s)
+            """,
+            alert,
+        )
+
 
-            date_range = (processing_day, processing_day + ONE_DAY, processing_day, processing_day + ONE_DAY)
-            cursor.execute(query, date_range)
-            result = cursor.fetchone()
-
-            insert_query = """
-                INSERT into aggregate_stats
-                (
-                        day,
-                        total_users,
-                        total_nonbridged_users,
-                        total_room_count,
-                        daily_active_users,
-                        daily_active_rooms,
-                        daily_messages,
-                        daily_sent_messages,
-                        daily_active_e2ee_rooms,
-                        daily_e2ee_messages,
-                        daily_sent_e2ee_messages,
-                        monthly_active_users,
-                        r30_users_all,
-                        r30_users_android,
-                        r30_users_ios,
-                        r30_users_electron,
-                        r30_users_web,
-                        r30v2_users_all,
-                        r30v2_users_android,
-                        r30v2_users_ios,
-                        r30v2_users_electron,
-                        r30v2_users_web,
-                        daily_user_type_native,
-                        daily_user_type_bridged,
-                        daily_user_type_guest,
-                        daily_active_homeservers,
-                        server_context
-                ) VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s,
-                          %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s,
-            %s, %s, %s)"""
-            insert_data = [x if x is None else int(x) for x in result]
-            # insert day at the front
-            insert_data.insert(0, processing_day)
-            # append context at the end
-            insert_data.append(None)
-            cursor.execute(insert_query, insert_data)
-            db.commit()
-            processing_day = processing_day + ONE_DAY
+def send_alerts(alerts: List[Dict], webhooks: Sequence[str]):
+    """POSTs each alert as JSON to every webhook. Failures are logged and
+    otherwise ignored, as the alerts are already recorded in the database."""
+    for alert in alerts:
+        body = json.dumps(alert).encode()
+        for url in webhooks:
+            request = urllib.request.Request(
+                url, data=body, headers={"Content-Type": "application/json"}
+            )
+            try:
+                with urllib.request.urlopen(request, timeout=10):
+                    pass
+            except OSError as e:
+                logger.warning("Error sending alert for %s to %s: %s", alert["metric"], url, e)
 
 
 def create_table(db, schema):
@@ -1,13 +1,19 @@
+import tempfile
 from typing import Dict, Optional
-from unittest import TestCase
+from unittest import TestCase, mock
 
 from pymysql.cursors import Cursor
 
+import aggregate
 from aggregate import Config
-from aggregate import set_up_aggregate_stats_table
+from aggregate import set_up_tables
+from aggregate import AnomalyRules, detect_anomalies, record_alerts
 from aggregate import METRIC_COLUMNS
 from aggregate import INITIAL_DAY, aggregate_until_today
-from aggregate import ONE_DAY
+from aggregate import AggregationOptions, aggregate_range, aggregate_requested
+from aggregate import ONE_DAY, ONE_HOUR
+from aggregate import HOUR, WEEK, MONTH, aggregate_rollups_until
+from aggregate import ReportFilters, DIMENSIONS
 
 
 def insert_recording(
@@ -40,6 +46,48 @@ def insert_recording(
     )
 
 
+def insert_homeserver(
+    cursor: Cursor,
+    homeserver: str,
+    first_seen: int,
+    last_seen: int,
+):
+    """
+    Insert a row that emulates Panopticon's tracking of a homeserver.
+    """
+    cursor.execute(
+        """
+        INSERT INTO homeservers
+        SET
+            homeserver = %s,
+            first_seen = %s,
+            last_seen = %s,
+            report_count = 1;
+        """,
+        (homeserver, first_seen, last_seen),
+    )
+
+
+def select_lifecycle(cursor: Cursor, day: int) -> Optional[Dict[str, int]]:
+    """
+    Select the homeserver lifecycle counts for a given day.
+    """
+    columns = ("new_homeservers", "returning_homeservers", "churned_homeservers")
+    cursor.execute(
+        f"""
+        SELECT {", ".join(columns)}
+        FROM aggregate_homeserver_lifecycle
+        WHERE day = %s
+        """,
+        (day,),
+    )
+    row = cursor.fetchone()
+    if row is None:
+        return None
+    else:
+        return dict(zip(columns, row))
+
+
 def select_aggregate(cursor: Cursor, day: int) -> Optional[Dict[str, int]]:
     """
     Select the aggregated statistics for a given day.
@@ -72,6 +120,56 @@ class AggregateTestCase(TestCase):
         db = self.config.connect_db()
         with db.cursor() as cursor:
             cursor.execute("DROP TABLE IF EXISTS aggregate_stats;")
+            cursor.execute("DROP TABLE IF EXISTS aggregate_homeserver_lifecycle;")
+            cursor.execute("DROP TABLE IF EXISTS aggregate_homeserver_events;")
+            cursor.execute("DROP TABLE IF EXISTS aggregate_alerts;")
+            cursor.execute("DROP TABLE IF EXISTS aggregate_distributions;")
+            cursor.execute("DROP TABLE IF EXISTS aggregate_size_histogram;")
+            cursor.execute("DROP TABLE IF EXISTS aggregate_breakdowns;")
+            cursor.execute("DROP TABLE IF EXISTS aggregate_carried_forward;")
+            cursor.execute("DROP TABLE IF EXISTS aggregate_rollups;")
+            cursor.execute("DROP TABLE IF EXISTS recompute_requests;")
+            cursor.execute("DROP TABLE IF EXISTS homeservers;")
+            cursor.execute("DROP TABLE IF EXISTS homeserver_events;")
+            cursor.execute("DROP TABLE IF EXISTS homeserver_verifications;")
+            cursor.execute(
+                """
+                CREATE TABLE homeserver_verifications (
+                    homeserver VARCHAR(256) NOT NULL PRIMARY KEY,
+                    checked_at BIGINT,
+                    delegated_server TEXT,
+                    resolved_ips TEXT,
+                    reporting_ip TEXT,
+                    ip_matches INT,
+                    error TEXT
+                );
+                """
+            )
+            cursor.execute(
+                """
+                CREATE TABLE homeserver_events (
+                    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+                    homeserver VARCHAR(256),
+                    timestamp BIGINT,
+                    event_type VARCHAR(32),
+                    old_value TEXT,
+                    new_value TEXT
+                );
+                """
+            )
+            cursor.execute(
+                """
+                CREATE TABLE homeservers (
+                    homeserver VARCHAR(256) NOT NULL PRIMARY KEY,
+                    first_seen BIGINT,
+                    last_seen BIGINT,
+                    report_count BIGINT,
+                    software TEXT,
+                    last_version TEXT,
+                    last_ip TEXT
+                );
+                """
+            )
 
             for stats_table in ('stats', 'dendrite_stats'):
                 cursor.execute(f"DROP TABLE IF EXISTS {stats_table};")
@@ -86,11 +184,21 @@ class AggregateTestCase(TestCase):
                         remote_addr TEXT,
                         forwarded_for TEXT,
                         user_agent TEXT,
+                        database_engine TEXT,
+                        python_version TEXT,
+                        log_level TEXT,
+                        goversion TEXT,
+                        goos TEXT,
+                        goarch TEXT,
+                        monolith INT,
+                        nats_embedded INT,
+                        excluded INT,
+                        trust_score DOUBLE,
                         {metric_lines}
                     );
                     """
             )
-        set_up_aggregate_stats_table(db)
+        set_up_tables(db)
 
     def test_sum_of_metrics(self):
         """
@@ -157,3 +265,571 @@ class AggregateTestCase(TestCase):
             self.assertIsNot(row, None)
             self.assertEqual(row["total_users"], 1)
             self.assertEqual(row["daily_active_homeservers"], 1)
+
+    def test_homeserver_lifecycle(self):
+        """
+        Tests that new, returning and churned homeservers are counted.
+        """
+
+        day = INITIAL_DAY + 3 * ONE_DAY
+        db = self.config.connect_db()
+        with db.cursor() as cursor:
+            # first seen today
+            insert_homeserver(cursor, "new", day + 300, day + 300)
+            insert_recording(cursor, "new", day + 300, {metric: 1 for metric in METRIC_COLUMNS})
+            # seen before and reported again today
+            insert_homeserver(cursor, "returning", INITIAL_DAY + 300, day + 300)
+            insert_recording(
+                cursor, "returning", day + 300, {metric: 1 for metric in METRIC_COLUMNS},
+                table="dendrite_stats",
+            )
+            # last reported two days before today
+            insert_homeserver(cursor, "churned", INITIAL_DAY + 300, INITIAL_DAY + ONE_DAY + 300)
+            insert_recording(
+                cursor, "churned", INITIAL_DAY + ONE_DAY + 300, {metric: 1 for metric in METRIC_COLUMNS}
+            )
+
+        options = AggregationOptions(churn_days=2)
+        aggregate_until_today(db, today=day + ONE_DAY, options=options)
+
+        with db.cursor() as cursor:
+            row = select_lifecycle(cursor, day)
+            self.assertEqual(
+                row,
+                {"new_homeservers": 1, "returning_homeservers": 1, "churned_homeservers": 1},
+            )
+
+        # a later report does not change the churn of days already aggregated
+        with db.cursor() as cursor:
+            insert_recording(cursor, "churned", day + ONE_DAY + 300, {metric: 1 for metric in METRIC_COLUMNS})
+            cursor.execute(
+                "UPDATE homeservers SET last_seen = %s WHERE homeserver = 'churned'", (day + ONE_DAY + 300,)
+            )
+        aggregate_range(db, day, day + ONE_DAY, options)
+        with db.cursor() as cursor:
+            self.assertEqual(select_lifecycle(cursor, day)["churned_homeservers"], 1)
+
+    def test_homeserver_events(self):
+        """
+        Tests that homeserver events are counted per day and type.
+        """
+
+        day = INITIAL_DAY + ONE_DAY
+        db = self.config.connect_db()
+        with db.cursor() as cursor:
+            for homeserver, timestamp, event_type in (
+                ("hs1", day + 300, "restart"),
+                ("hs2", day + 600, "restart"),
+                ("hs1", day + 300, "upgrade"),
+                ("hs1", day + ONE_DAY + 300, "restart"),
+            ):
+                cursor.execute(
+                    """
+                    INSERT INTO homeserver_events (homeserver, timestamp, event_type)
+                    VALUES (%s, %s, %s)
+                    """,
+                    (homeserver, timestamp, event_type),
+                )
+
+        aggregate_until_today(db, today=day + ONE_DAY)
+
+        with db.cursor() as cursor:
+            cursor.execute(
+                """
+                SELECT event_type, count FROM aggregate_homeserver_events
+                WHERE day = %s ORDER BY event_type
+                """,
+                (day,),
+            )
+            self.assertEqual(cursor.fetchall(), (("restart", 2), ("upgrade", 1)))
+
+    def test_anomalies(self):
+        """
+        Tests that a sudden drop in an aggregate is reported by both rules,
+        while ordinary day-to-day variation is not.
+        """
+
+        db = self.config.connect_db()
+        with db.cursor() as cursor:
+            for i, (total_users, daily_messages) in enumerate(
+                [(100, 50), (101, 52), (99, 49), (100, 51), (102, 50), (98, 52), (100, 50), (60, 51)]
+            ):
+                cursor.execute(
+                    "INSERT INTO aggregate_stats (day, total_users, daily_messages) VALUES (%s, %s, %s)",
+                    (INITIAL_DAY + i * ONE_DAY, total_users, daily_messages),
+                )
+
+            day = INITIAL_DAY + 7 * ONE_DAY
+            alerts = detect_anomalies(cursor, day, AnomalyRules(max_percent_change=30, max_zscore=4))
+            self.assertEqual(
+                [(alert["metric"], alert["rule"]) for alert in alerts],
+                [("total_users", "percent_change"), ("total_users", "zscore")],
+            )
+            self.assertEqual(alerts[0]["baseline"], 100)
+            self.assertEqual(alerts[0]["score"], -40)
+
+            # not enough history for the previous day
+            self.assertEqual(detect_anomalies(cursor, day - ONE_DAY, AnomalyRules()), [])
+
+            record_alerts(cursor, alerts)
+            cursor.execute("SELECT metric, rule, value FROM aggregate_alerts WHERE day = %s ORDER BY rule", (day,))
+            self.assertEqual(cursor.fetchall(), (("total_users", "percent_change", 60), ("total_users", "zscore", 60)))
+
+    def test_distributions(self):
+        """
+        Tests that percentiles are taken over the latest report from each
+        homeserver, counting each homeserver once, that homeservers are
+        bucketed by size, and that the sums agree with both.
+        """
+
+        day = INITIAL_DAY + ONE_DAY
+        db = self.config.connect_db()
+        with db.cursor() as cursor:
+            for i, total_users in enumerate((1, 5, 20, 300, 4000)):
+                insert_recording(
+                    cursor,
+                    f"hs{i}",
+                    day + 300,
+                    {metric: total_users for metric in METRIC_COLUMNS},
+                    table="dendrite_stats" if i == 4 else "stats",
+                )
+            # superseded by the later report from the same homeserver
+            insert_recording(cursor, "hs0", day + 100, {metric: 100000 for metric in METRIC_COLUMNS})
+            # sent at the same time as hs1's other report, and as Dendrite
+            insert_recording(cursor, "hs1", day + 300, {metric: 5 for metric in METRIC_COLUMNS})
+            insert_recording(
+                cursor, "hs1", day + 300, {metric: 5 for metric in METRIC_COLUMNS}, table="dendrite_stats"
+            )
+
+        aggregate_until_today(db, today=day + ONE_DAY)
+
+        with db.cursor() as cursor:
+            cursor.execute(
+                "SELECT count, p50, p90, p99, max FROM aggregate_distributions WHERE day = %s AND metric = 'total_users'",
+                (day,),
+            )
+            self.assertEqual(cursor.fetchone(), (5, 20, 4000, 4000, 4000))
+
+            cursor.execute(
+                "SELECT bucket_min, bucket_max, homeservers, total_users FROM aggregate_size_histogram WHERE day = %s ORDER BY bucket_min",
+                (day,),
+            )
+            self.assertEqual(
+                cursor.fetchall(),
+                (
+                    (1, 10, 2, 6),
+                    (10, 100, 1, 20),
+                    (100, 1000, 1, 300),
+                    (1000, 10000, 1, 4000),
+                    (10000, 100000, 0, 0),
+                    (100000, 1000000, 0, 0),
+                    (1000000, None, 0, 0),
+                ),
+            )
+
+            cursor.execute(
+                "SELECT total_users, daily_active_homeservers FROM aggregate_stats WHERE day = %s", (day,)
+            )
+            self.assertEqual(cursor.fetchone(), (4326, 5))
+
+    def test_breakdowns(self):
+        """
+        Tests that metrics are summed for each value of each dimension.
+        """
+
+        day = INITIAL_DAY + ONE_DAY
+        db = self.config.connect_db()
+        with db.cursor() as cursor:
+            insert_recording(cursor, "hs1", day + 300, {metric: 1 for metric in METRIC_COLUMNS})
+            insert_recording(cursor, "hs2", day + 300, {metric: 2 for metric in METRIC_COLUMNS})
+            insert_recording(
+                cursor, "hs3", day + 300, {metric: 4 for metric in METRIC_COLUMNS},
+                table="dendrite_stats",
+            )
+            cursor.execute("UPDATE stats SET database_engine = 'Sqlite3' WHERE homeserver = 'hs1'")
+            cursor.execute("UPDATE stats SET database_engine = 'PostgreSQL' WHERE homeserver = 'hs2'")
+            cursor.execute("UPDATE dendrite_stats SET database_engine = 'PostgreSQL', monolith = 1")
+
+        aggregate_until_today(
+            db,
+            today=day + ONE_DAY,
+            options=AggregationOptions(breakdown_dimensions=("database_engine", "server_software", "monolith")),
+        )
+
+        with db.cursor() as cursor:
+            cursor.execute(
+                """
+                SELECT dimension, dimension_value, metric, value FROM aggregate_breakdowns
+                WHERE day = %s AND metric IN ('homeservers', 'total_users')
+                ORDER BY dimension, dimension_value, metric
+                """,
+                (day,),
+            )
+            self.assertEqual(
+                cursor.fetchall(),
+                (
+                    ("database_engine", "PostgreSQL", "homeservers", 2),
+                    ("database_engine", "PostgreSQL", "total_users", 6),
+                    ("database_engine", "Sqlite3", "homeservers", 1),
+                    ("database_engine", "Sqlite3", "total_users", 1),
+                    ("monolith", "1", "homeservers", 1),
+                    ("monolith", "1", "total_users", 4),
+                    ("monolith", "unknown", "homeservers", 2),
+                    ("monolith", "unknown", "total_users", 3),
+                    ("server_software", "dendrite", "homeservers", 1),
+                    ("server_software", "dendrite", "total_users", 4),
+                    ("server_software", "synapse", "homeservers", 2),
+                    ("server_software", "synapse", "total_users", 3),
+                ),
+            )
+
+    def test_late_reports(self):
+        """
+        Tests that reports arriving after their day was aggregated are taken
+        into account by the next run, without duplicating rows.
+        """
+
+        day = INITIAL_DAY + ONE_DAY
+        db = self.config.connect_db()
+        with db.cursor() as cursor:
+            insert_recording(cursor, "hs1", day + 300, {metric: 1 for metric in METRIC_COLUMNS})
+
+        aggregate_until_today(db, today=day + ONE_DAY)
+
+        with db.cursor() as cursor:
+            insert_recording(cursor, "hs2", day + 600, {metric: 2 for metric in METRIC_COLUMNS})
+
+        aggregate_until_today(db, today=day + 2 * ONE_DAY)
+
+        with db.cursor() as cursor:
+            row = select_aggregate(cursor, day)
+            self.assertEqual(row["total_users"], 3)
+            self.assertEqual(row["daily_active_homeservers"], 2)
+            cursor.execute("SELECT COUNT(*) FROM aggregate_stats WHERE day = %s", (day,))
+            self.assertEqual(cursor.fetchone()[0], 1)
+            cursor.execute(
+                "SELECT COUNT(*) FROM aggregate_distributions WHERE day = %s AND metric = 'total_users'",
+                (day,),
+            )
+            self.assertEqual(cursor.fetchone()[0], 1)
+
+    def test_recompute(self):
+        """
+        Tests that a range of days can be aggregated again, replacing the
+        previous aggregates, even outside the automatically recomputed days.
+        """
+
+        day = INITIAL_DAY + ONE_DAY
+        db = self.config.connect_db()
+        with db.cursor() as cursor:
+            insert_recording(cursor, "hs1", day + 300, {metric: 1 for metric in METRIC_COLUMNS})
+
+        aggregate_until_today(db, today=day + 10 * ONE_DAY, options=AggregationOptions(recompute_days=0))
+
+        with db.cursor() as cursor:
+            cursor.execute("UPDATE stats SET total_users = 5")
+
+        aggregate_until_today(db, today=day + 10 * ONE_DAY, options=AggregationOptions(recompute_days=0))
+        with db.cursor() as cursor:
+            self.assertEqual(select_aggregate(cursor, day)["total_users"], 1)
+
+        aggregate_range(db, day, day + ONE_DAY)
+        with db.cursor() as cursor:
+            self.assertEqual(select_aggregate(cursor, day)["total_users"], 5)
+            cursor.execute("SELECT COUNT(*) FROM aggregate_stats")
+            self.assertEqual(cursor.fetchone()[0], 10)
+
+    def test_recompute_requests(self):
+        """
+        Tests that the days covered by a recompute request, such as after a
+        homeserver's reports were erased, are aggregated again once, along
+        with the days it would have been counted as churned.
+        """
+
+        day = INITIAL_DAY + ONE_DAY
+        db = self.config.connect_db()
+        with db.cursor() as cursor:
+            insert_recording(cursor, "hs1", day + 300, {metric: 1 for metric in METRIC_COLUMNS})
+            insert_recording(cursor, "hs2", day + 300, {metric: 2 for metric in METRIC_COLUMNS})
+            insert_homeserver(cursor, "hs1", day + 300, day + 300)
+            insert_homeserver(cursor, "hs2", day + 300, day + 300)
+
+        options = AggregationOptions(recompute_days=0, churn_days=2)
+        aggregate_until_today(db, today=day + 10 * ONE_DAY, options=options)
+        with db.cursor() as cursor:
+            self.assertEqual(select_lifecycle(cursor, day + 2 * ONE_DAY)["churned_homeservers"], 2)
+
+        with db.cursor() as cursor:
+            cursor.execute("DELETE FROM stats WHERE homeserver = 'hs2'")
+            cursor.execute("DELETE FROM homeservers WHERE homeserver = 'hs2'")
+            cursor.execute(
+                """
+                INSERT INTO recompute_requests (from_timestamp, to_timestamp, requested_at, reason)
+                VALUES (%s, %s, %s, 'erased hs2')
+                """,
+                (day + 300, day + 300, day + 10 * ONE_DAY),
+            )
+        db.commit()
+
+        aggregate_requested(db, today=day + 10 * ONE_DAY, options=options)
+        with db.cursor() as cursor:
+            self.assertEqual(select_aggregate(cursor, day)["total_users"], 1)
+            self.assertEqual(select_lifecycle(cursor, day + 2 * ONE_DAY)["churned_homeservers"], 1)
+            cursor.execute("SELECT COUNT(*) FROM recompute_requests WHERE completed_at IS NULL")
+            self.assertEqual(cursor.fetchone()[0], 0)
+
+        # completed requests are not aggregated again
+        with db.cursor() as cursor:
+            cursor.execute("UPDATE stats SET total_users = 5")
+        aggregate_requested(db, today=day + 10 * ONE_DAY, options=options)
+        with db.cursor() as cursor:
+            self.assertEqual(select_aggregate(cursor, day)["total_users"], 1)
+
+    def test_carry_forward(self):
+        """
+        Tests that a homeserver which misses a day is carried forward from its
+        previous report for up to carry_forward_days, without counting it as
+        active on that day.
+        """
+
+        day = INITIAL_DAY + ONE_DAY
+        db = self.config.connect_db()
+        with db.cursor() as cursor:
+            insert_recording(cursor, "hs1", day + 300, {metric: 1 for metric in METRIC_COLUMNS})
+            insert_recording(cursor, "hs2", day + 300, {metric: 2 for metric in METRIC_COLUMNS})
+            insert_recording(cursor, "hs2", day + ONE_DAY + 300, {metric: 3 for metric in METRIC_COLUMNS})
+
+        options = AggregationOptions(carry_forward_days=1)
+        aggregate_until_today(db, today=day + 3 * ONE_DAY, options=options)
+
+        with db.cursor() as cursor:
+            row = select_aggregate(cursor, day + ONE_DAY)
+            self.assertEqual(row["total_users"], 4)
+            self.assertEqual(row["daily_active_homeservers"], 1)
+            cursor.execute("SELECT homeserver, local_timestamp FROM aggregate_carried_forward WHERE day = %s", (day + ONE_DAY,))
+            self.assertEqual(cursor.fetchall(), (("hs1", day + 300),))
+
+            row = select_aggregate(cursor, day + 2 * ONE_DAY)
+            self.assertEqual(row["total_users"], 3)
+            self.assertEqual(row["daily_active_homeservers"], 0)
+
+    def test_rollups(self):
+        """
+        Tests the weekly and monthly rollups, which sum the latest report of
+        each homeserver in the period and count every homeserver active in it.
+        """
+
+        monday = INITIAL_DAY + 4 * ONE_DAY  # 2015-10-05
+        db = self.config.connect_db()
+        with db.cursor() as cursor:
+            insert_recording(cursor, "hs1", monday + 300, {metric: 1 for metric in METRIC_COLUMNS})
+            insert_recording(cursor, "hs1", monday + 2 * ONE_DAY, {metric: 2 for metric in METRIC_COLUMNS})
+            insert_recording(cursor, "hs2", monday + ONE_DAY, {metric: 5 for metric in METRIC_COLUMNS})
+
+        november = INITIAL_DAY + 31 * ONE_DAY
+        aggregate_rollups_until(db, november, AggregationOptions(rollups=(WEEK, MONTH)))
+
+        with db.cursor() as cursor:
+            cursor.execute(
+                """
+                SELECT granularity, period_start, period_end, total_users, active_homeservers
+                FROM aggregate_rollups WHERE total_users IS NOT NULL
+                ORDER BY granularity, period_start
+                """
+            )
+            self.assertEqual(
+                cursor.fetchall(),
+                (
+                    ("month", INITIAL_DAY, november, 7, 2),
+                    ("week", monday, monday + 7 * ONE_DAY, 7, 2),
+                ),
+            )
+
+    def test_rollups_start_at_first_report(self):
+        """
+        Tests that the first rollups start from the earliest report, rather
+        than from INITIAL_DAY.
+        """
+
+        monday = INITIAL_DAY + 4 * ONE_DAY
+        db = self.config.connect_db()
+        with db.cursor() as cursor:
+            insert_recording(cursor, "hs1", monday + 300, {metric: 1 for metric in METRIC_COLUMNS})
+
+        aggregate_rollups_until(db, monday + 3 * ONE_HOUR, AggregationOptions(rollups=(HOUR,)))
+
+        with db.cursor() as cursor:
+            cursor.execute("SELECT MIN(period_start), COUNT(*) FROM aggregate_rollups WHERE granularity = 'hour'")
+            self.assertEqual(cursor.fetchone(), (monday, 3))
+
+    def test_excluded_reports(self):
+        """
+        Tests that reports excluded by Panopticon's rules are left out of the
+        aggregates.
+        """
+
+        day = INITIAL_DAY + ONE_DAY
+        db = self.config.connect_db()
+        with db.cursor() as cursor:
+            insert_recording(cursor, "hs1", day + 300, {metric: 1 for metric in METRIC_COLUMNS})
+            insert_recording(cursor, "localhost", day + 300, {metric: 2 for metric in METRIC_COLUMNS})
+            cursor.execute("UPDATE stats SET excluded = 1 WHERE homeserver = 'localhost'")
+
+        aggregate_until_today(db, today=day + ONE_DAY)
+
+        with db.cursor() as cursor:
+            row = select_aggregate(cursor, day)
+            self.assertEqual(row["total_users"], 1)
+            self.assertEqual(row["daily_active_homeservers"], 1)
+
+    def test_min_trust_score(self):
+        """
+        Tests that reports scored below the minimum trust score are left out
+        of the aggregates, and that unscored reports are kept.
+        """
+
+        day = INITIAL_DAY + ONE_DAY
+        db = self.config.connect_db()
+        with db.cursor() as cursor:
+            insert_recording(cursor, "hs1", day + 300, {metric: 1 for metric in METRIC_COLUMNS})
+            insert_recording(cursor, "hs2", day + 300, {metric: 2 for metric in METRIC_COLUMNS})
+            insert_recording(cursor, "hs3", day + 300, {metric: 4 for metric in METRIC_COLUMNS})
+            cursor.execute("UPDATE stats SET trust_score = 0.9 WHERE homeserver = 'hs2'")
+            cursor.execute("UPDATE stats SET trust_score = 0 WHERE homeserver = 'hs3'")
+
+        aggregate_until_today(db, today=day + ONE_DAY, options=AggregationOptions(filters=ReportFilters(min_trust_score=0.5)))
+
+        with db.cursor() as cursor:
+            row = select_aggregate(cursor, day)
+            self.assertEqual(row["total_users"], 3)
+            self.assertEqual(row["daily_active_homeservers"], 2)
+
+    def test_exclude_ownership_mismatch(self):
+        """
+        Tests that homeservers found reporting from an address their name does
+        not resolve to can be left out of the aggregates.
+        """
+
+        day = INITIAL_DAY + ONE_DAY
+        db = self.config.connect_db()
+        with db.cursor() as cursor:
+            insert_recording(cursor, "hs1", day + 300, {metric: 1 for metric in METRIC_COLUMNS})
+            insert_recording(cursor, "hs2", day + 300, {metric: 2 for metric in METRIC_COLUMNS})
+            insert_recording(cursor, "hs3", day + 300, {metric: 4 for metric in METRIC_COLUMNS})
+            cursor.execute(
+                "INSERT INTO homeserver_verifications (homeserver, ip_matches) VALUES ('hs2', 1), ('hs3', 0)"
+            )
+
+        options = AggregationOptions(filters=ReportFilters(exclude_ownership_mismatch=True))
+        aggregate_until_today(db, today=day + ONE_DAY, options=options)
+
+        with db.cursor() as cursor:
+            row = select_aggregate(cursor, day)
+            self.assertEqual(row["total_users"], 3)
+            self.assertEqual(row["daily_active_homeservers"], 2)
+
+
+class ConfigTestCase(TestCase):
+    def test_config_file(self):
+        """
+        Tests that the aggregation is configured by the config file shared with
+        panopticon, and that environment variables override it.
+        """
+
+        with tempfile.NamedTemporaryFile(mode="w", suffix=".toml") as f:
+            f.write(
+                """
+                [storage]
+                name = "panopticon"
+                user = "aggregator"
+                password = "secret"
+                port = 3307
+
+                [aggregation]
+                churn_days = 10
+                rollups = ["week", "month"]
+                exclude_ownership_mismatch = true
+                """
+            )
+            f.flush()
+            config = Config({"PANOPTICON_CONFIG": f.name, "PANOPTICON_CHURN_DAYS": "5", "PANOPTICON_DB_HOST": "db"})
+
+        self.assertEqual(config.db_name, "panopticon")
+        self.assertEqual(config.db_host, "db")
+        self.assertEqual(config.db_port, 3307)
+        self.assertEqual(config.options.churn_days, 5)
+        self.assertEqual(config.options.rollups, [WEEK, MONTH])
+        self.assertEqual(config.options.breakdown_dimensions, list(DIMENSIONS))
+        self.assertTrue(config.options.filters.exclude_ownership_mismatch)
+
+    def test_data_source(self):
+        """
+        Tests that the aggregation connects to the database panopticon uses
+        when only its data source name is configured.
+        """
+
+        with tempfile.NamedTemporaryFile(mode="w", suffix=".toml") as f:
+            f.write(
+                """
+                [storage]
+                driver = "mysql"
+                db = "aggregator:se:cret@tcp(db.example.com:3307)/panopticon?parseTime=true"
+                """
+            )
+            f.flush()
+            config = Config({"PANOPTICON_CONFIG": f.name})
+
+        self.assertEqual(
+            (config.db_user, config.db_password, config.db_host, config.db_port, config.db_name),
+            ("aggregator", "se:cret", "db.example.com", 3307, "panopticon"),
+        )
+        with self.assertRaises(ValueError):
+            Config({"PANOPTICON_DB_DRIVER": "sqlite3", "PANOPTICON_DB": "stats.db"})
+
+    def test_tenants(self):
+        """
+        Tests that the databases of the tenants are read from the tenants
+        config file, so that they can each be aggregated.
+        """
+
+        with tempfile.NamedTemporaryFile(mode="w", suffix=".json") as f:
+            f.write('{"tenants": [{"name": "acme", "database": "panopticon_acme", "hostnames": ["stats.acme.test"]}]}')
+            f.flush()
+            config = Config({
+                "PANOPTICON_DB_NAME": "panopticon",
+                "PANOPTICON_DB_USER": "aggregator",
+                "PANOPTICON_DB_PASSWORD": "secret",
+                "PANOPTICON_TENANTS_CONFIG": f.name,
+            })
+
+        self.assertEqual(config.tenants, {"acme": "panopticon_acme"})
+
+
+class MainTestCase(TestCase):
+    def test_failing_tenant(self):
+        """
+        Tests that a tenant whose database fails does not stop the others
+        from being aggregated, but is reported in the exit status.
+        """
+
+        class FakeConfig:
+            tenants = {"broken": "panopticon_broken", "acme": "panopticon_acme"}
+            options = AggregationOptions()
+
+            def connect_db(self, tenant: Optional[str] = None):
+                if tenant == "broken":
+                    raise RuntimeError("no such database")
+                return mock.MagicMock(name=tenant or "default")
+
+        aggregated = []
+        argv = ["aggregate.py", "recompute", "--from", "2022-01-01", "--to", "2022-01-02"]
+        with mock.patch.object(aggregate, "Config", FakeConfig), \
+                mock.patch.object(aggregate, "set_up_tables"), \
+                mock.patch.object(aggregate, "aggregate_range", lambda db, *args: aggregated.append(db)), \
+                mock.patch("sys.argv", argv), \
+                self.assertLogs("aggregate", "ERROR"), \
+                self.assertRaises(SystemExit) as exit:
+            aggregate.main()
+
+        self.assertEqual(exit.exception.code, 1)
+        self.assertEqual(len(aggregated), 2)
@@ -0,0 +1,305 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// defaultPorts are stripped from server names, so that "example.org:8448"
+// and "example.org:443" are counted as the same homeserver as "example.org".
+var defaultPorts = map[int]bool{443: true, 8448: true}
+
+// normalizeServerName validates a server name against the grammar in
+// https://spec.matrix.org/latest/appendices/#server-name, and returns the
+// form used to identify the homeserver: lowercase, with internationalised
+// domain names converted to punycode and any default port stripped.
+func normalizeServerName(name string) (string, error) {
+	host, port := name, ""
+	if strings.HasPrefix(name, "[") {
+		end := strings.Index(name, "]")
+		if end < 0 {
+			return "", fmt.Errorf("invalid server name %q: unterminated IPv6 literal", name)
+		}
+		host = name[1:end]
+		if rest := name[end+1:]; rest != "" {
+			if rest[0] != ':' {
+				return "", fmt.Errorf("invalid server name %q: unexpected %q after IPv6 literal", name, rest)
+			}
+			port = rest[1:]
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !strings.Contains(host, ":") {
+			return "", fmt.Errorf("invalid server name %q: invalid IPv6 literal", name)
+		}
+		host = "[" + ip.String() + "]"
+	} else {
+		if i := strings.LastIndex(name, ":"); i >= 0 {
+			host, port = name[:i], name[i+1:]
+		}
+		var err error
+		if host, err = idna.Lookup.ToASCII(host); err != nil {
+			return "", fmt.Errorf("invalid server name %q: %v", name, err)
+		}
+		if host == "" || len(host) > 255 {
+			return "", fmt.Errorf("invalid server name %q: hostname must be 1 to 255 characters", name)
+		}
+		for _, c := range host {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+				return "", fmt.Errorf("invalid server name %q: invalid character %q in hostname", name, c)
+			}
+		}
+	}
+
+	if port == "" {
+		if strings.HasSuffix(name, ":") {
+			return "", fmt.Errorf("invalid server name %q: empty port", name)
+		}
+		return host, nil
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || len(port) > 5 || n < 1 || n > 65535 || strings.TrimLeft(port, "0123456789") != "" {
+		return "", fmt.Errorf("invalid server name %q: invalid port %q", name, port)
+	}
+	if defaultPorts[n] {
+		return host, nil
+	}
+	return host + ":" + strconv.Itoa(n), nil
+}
+
+// normalizeHomeserver replaces the Homeserver of a report with its
+// normalized form, keeping the name as sent in OriginalHomeserver.
+func (c *CommonStats) normalizeHomeserver() error {
+	normalized, err := normalizeServerName(c.Homeserver)
+	if err != nil {
+		return err
+	}
+	c.OriginalHomeserver = c.Homeserver
+	c.Homeserver = normalized
+	return nil
+}
+
+// normalizeHistory renormalizes the names of the homeservers recorded by
+// older versions of panopticon, merging the homeservers which turn out to be
+// the same. Names which are not valid server names are left as they are.
+func normalizeHistory(tx *sql.Tx) error {
+	for _, table := range []string{"stats", "dendrite_stats"} {
+		if _, err := tx.Exec(fmt.Sprintf(
+			"UPDATE %s SET original_homeserver = homeserver WHERE original_homeserver IS NULL", table,
+		)); err != nil {
+			return err
+		}
+		renames, err := normalizedNames(tx, fmt.Sprintf("SELECT DISTINCT original_homeserver FROM %s", table))
+		if err != nil {
+			return err
+		}
+		for original, normalized := range renames {
+			if _, err := tx.Exec(rebind(fmt.Sprintf(
+				"UPDATE %s SET homeserver = ? WHERE original_homeserver = ?", table,
+			)), normalized, original); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, t := range homeserverDataTables {
+		switch t.name {
+		case "stats", "dendrite_stats", "homeservers":
+			continue
+		}
+		exists, err := tableExists(tx, t.name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		renames, err := normalizedNames(tx, fmt.Sprintf("SELECT DISTINCT %s FROM %s", t.column, t.name))
+		if err != nil {
+			return err
+		}
+		for original, normalized := range renames {
+			if err := renameHomeserver(tx, t, original, normalized); err != nil {
+				return err
+			}
+		}
+	}
+
+	renames, err := normalizedNames(tx, "SELECT homeserver FROM homeservers")
+	if err != nil {
+		return err
+	}
+	for original, normalized := range renames {
+		if err := mergeHomeserver(tx, original, normalized); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizedNames maps each of the names returned by a query which changes
+// when normalized to its normalized form.
+func normalizedNames(tx *sql.Tx, qry string) (map[string]string, error) {
+	rows, err := tx.Query(qry)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	renames := make(map[string]string)
+	for rows.Next() {
+		var name sql.NullString
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		normalized, err := normalizeServerName(name.String)
+		if err != nil {
+			log.Printf("Not normalizing %q: %v", name.String, err)
+			continue
+		}
+		if normalized != name.String {
+			renames[name.String] = normalized
+		}
+	}
+	return renames, rows.Err()
+}
+
+// renameHomeserver renames a homeserver in one of the homeserverDataTables.
+// In tables keyed by homeserver, rows which then have the same key are
+// merged.
+func renameHomeserver(tx *sql.Tx, t homeserverDataTable, original, normalized string) error {
+	// a case-insensitive collation finds the original rows under the new
+	// name, so they cannot conflict with any others
+	same := false
+	if t.merge != "" {
+		if err := tx.QueryRow(rebind("SELECT ? = ?"), original, normalized).Scan(&same); err != nil {
+			return err
+		}
+	}
+	if t.merge == "" || same {
+		_, err := tx.Exec(rebind(fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", t.name, t.column, t.column)),
+			normalized, original,
+		)
+		return err
+	}
+
+	key := t.column
+	copied := t.columns
+	if t.key != "" {
+		key += ", " + t.key
+		copied = t.key + ", " + copied
+	}
+	if _, err := tx.Exec(rebind(fmt.Sprintf("INSERT INTO %s (%s, %s) SELECT ?, %s FROM %s WHERE %s = ?",
+		t.name, t.column, copied, copied, t.name, t.column,
+	)+onConflict(key, t.merge)), normalized, original); err != nil {
+		return err
+	}
+	_, err := tx.Exec(rebind(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", t.name, t.column)), original)
+	return err
+}
+
+// mergeHomeserver renames a row of the homeservers table. If there is
+// already a row with the new name, the two are merged, keeping the details
+// of whichever was seen last.
+func mergeHomeserver(tx *sql.Tx, original, normalized string) error {
+	type seen struct {
+		name                             string
+		firstSeen, lastSeen, reportCount int64
+	}
+	query := func(name string) (s seen, err error) {
+		err = tx.QueryRow(rebind(`SELECT homeserver, first_seen, last_seen, report_count FROM homeservers WHERE homeserver = ?`),
+			name,
+		).Scan(&s.name, &s.firstSeen, &s.lastSeen, &s.reportCount)
+		return s, err
+	}
+	orig, err := query(original)
+	if err != nil {
+		return err
+	}
+	// a case-insensitive collation may find the original row again
+	norm, err := query(normalized)
+	if err == sql.ErrNoRows || err == nil && norm.name == original {
+		_, err = tx.Exec(rebind(`UPDATE homeservers SET homeserver = ? WHERE homeserver = ?`), normalized, original)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	newer, older := orig, norm
+	if norm.lastSeen > orig.lastSeen {
+		newer, older = norm, orig
+	}
+	firstSeen := orig.firstSeen
+	if norm.firstSeen < firstSeen {
+		firstSeen = norm.firstSeen
+	}
+	if _, err := tx.Exec(rebind(`UPDATE homeservers SET first_seen = ?, report_count = ? WHERE homeserver = ?`),
+		firstSeen, orig.reportCount+norm.reportCount, newer.name,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(rebind(`DELETE FROM homeservers WHERE homeserver = ?`), older.name); err != nil {
+		return err
+	}
+	_, err = tx.Exec(rebind(`UPDATE homeservers SET homeserver = ? WHERE homeserver = ?`), normalized, newer.name)
+	return err
+}
+
+// normalizeCommand implements "panopticon normalize-homeservers", which
+// renormalizes the homeserver names recorded so far.
+func normalizeCommand(args []string) {
+	if err := loadConfig(configPath()); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	fs := flag.NewFlagSet("normalize-homeservers", flag.ExitOnError)
+	fs.StringVar(dbDriver, "db-driver", *dbDriver, "the database driver to use")
+	fs.StringVar(dbPath, "db", *dbPath, "the data source to use, for sqlite this is the path to the file")
+	fs.StringVar(tenantsConfig, "tenants-config", *tenantsConfig, "the JSON file listing tenants")
+	tenant := fs.String("tenant", "", "the tenant whose database to normalize, if not the default one")
+	fs.Parse(args)
+
+	dsn, err := tenantDatabase(*tenantsConfig, *tenant)
+	if err != nil {
+		log.Fatalf("Invalid --tenant: %v", err)
+	}
+	db, err := openDB(dsn)
+	if err != nil {
+		log.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close()
+	if err := createTables(db); err != nil {
+		log.Fatalf("Error creating database: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("Error normalizing homeservers: %v", err)
+	}
+	defer tx.Rollback()
+	if err := normalizeHistory(tx); err != nil {
+		log.Fatalf("Error normalizing homeservers: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("Error normalizing homeservers: %v", err)
+	}
+}
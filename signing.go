@@ -0,0 +1,312 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// errNoSignature is returned by verifyReport for reports which are not
+	// signed by the homeserver they name.
+	errNoSignature = errors.New("report is not signed")
+	// errKeysUnavailable is returned by verifyReport when the keys of the
+	// homeserver could not be found, so the signature could not be checked.
+	errKeysUnavailable = errors.New("keys unavailable")
+)
+
+// KeyResolver finds the ed25519 keys a homeserver signs with.
+type KeyResolver interface {
+	// VerifyKeys returns the keys of a homeserver by key ID, such as
+	// "ed25519:a_abcd". client identifies whoever sent the report, for
+	// limiting the fetches each client causes.
+	VerifyKeys(serverName, client string) (map[string]ed25519.PublicKey, error)
+}
+
+// verifyReport checks the signature of a report body made by the homeserver
+// named in it, in the format used for signing JSON in Matrix. The homeserver
+// is identified by its name as sent, as that is what it signs with, and
+// client is passed on to keys.VerifyKeys.
+func verifyReport(body []byte, serverName, client string, keys KeyResolver) error {
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return err
+	}
+	sigs, _ := obj["signatures"].(map[string]interface{})
+	if _, ok := sigs[serverName]; !ok {
+		return errNoSignature
+	}
+	verifyKeys, err := keys.VerifyKeys(serverName, client)
+	if err != nil {
+		return fmt.Errorf("%w for %s: %v", errKeysUnavailable, serverName, err)
+	}
+	return verifyJSON(obj, serverName, verifyKeys)
+}
+
+// verifyJSON checks that a JSON object carries a valid signature from
+// serverName, made with any of the given keys.
+func verifyJSON(obj map[string]interface{}, serverName string, keys map[string]ed25519.PublicKey) error {
+	sigs, _ := obj["signatures"].(map[string]interface{})
+	serverSigs, _ := sigs[serverName].(map[string]interface{})
+	if len(serverSigs) == 0 {
+		return errNoSignature
+	}
+
+	signed := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		if k != "signatures" && k != "unsigned" {
+			signed[k] = v
+		}
+	}
+	message, err := canonicalJSON(signed)
+	if err != nil {
+		return err
+	}
+
+	for keyID, sig := range serverSigs {
+		key, ok := keys[keyID]
+		if !ok {
+			continue
+		}
+		sigStr, _ := sig.(string)
+		sigBytes, err := decodeBase64(sigStr)
+		if err != nil {
+			return fmt.Errorf("invalid signature %s: %w", keyID, err)
+		}
+		if !ed25519.Verify(key, message, sigBytes) {
+			return fmt.Errorf("signature %s of %s does not match", keyID, serverName)
+		}
+		return nil
+	}
+	return fmt.Errorf("no signature of %s with a known key", serverName)
+}
+
+// canonicalJSON encodes a value as Matrix canonical JSON: object keys sorted,
+// no insignificant whitespace and no unnecessary escaping.
+func canonicalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// decodeBase64 decodes Matrix's unpadded base64, tolerating padding.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// HTTPKeyResolver fetches the keys of homeservers from their key server
+// endpoint, caching them until they expire. As the server names come from
+// whoever sends a report, the cache is limited to the most recently used
+// keyCacheSize servers, failures are cached briefly so that reports cannot
+// make us fetch keys for every push, and fetches are limited both in total
+// and per client.
+type HTTPKeyResolver struct {
+	URLFormat string // if set, used instead of resolving servers, with %s for the server name
+	Client    *http.Client
+	Servers   *ServerResolver
+
+	mu       sync.Mutex
+	cache    map[string]*list.Element // of *cachedKeys, in lru
+	lru      *list.List               // most recently used first
+	fetching map[string]*keyFetch
+	clients  *RateLimiter
+}
+
+type cachedKeys struct {
+	serverName string
+	keys       map[string]ed25519.PublicKey
+	err        error
+	expires    time.Time
+}
+
+// keyFetch is a fetch in progress, which other reports for the same server
+// wait for rather than fetching the keys again.
+type keyFetch struct {
+	done chan struct{}
+	keys map[string]ed25519.PublicKey
+	err  error
+}
+
+const (
+	// maxKeyCacheTime limits how long keys are cached, however long they
+	// claim to be valid for.
+	maxKeyCacheTime = time.Hour
+	// keyFailureCacheTime is how long a failure to fetch keys is cached
+	// before they are fetched again.
+	keyFailureCacheTime = time.Minute
+	// keyCacheSize is the number of servers whose keys are cached.
+	keyCacheSize = 10000
+	// maxKeyFetches is the number of fetches made at once. Reports needing
+	// another fetch are not verified.
+	maxKeyFetches = 8
+	// keyFetchesPerClient is the number of fetches each client may cause per
+	// keyFetchPeriod.
+	keyFetchesPerClient = 10
+	keyFetchPeriod      = time.Minute
+)
+
+// errTooManyKeyFetches is returned by VerifyKeys when fetching the keys
+// would exceed the limits on fetches.
+var errTooManyKeyFetches = errors.New("too many key fetches")
+
+func (r *HTTPKeyResolver) VerifyKeys(serverName, client string) (map[string]ed25519.PublicKey, error) {
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = make(map[string]*list.Element)
+		r.lru = list.New()
+		r.fetching = make(map[string]*keyFetch)
+		r.clients = &RateLimiter{Reports: keyFetchesPerClient, Period: keyFetchPeriod}
+	}
+	if e, ok := r.cache[serverName]; ok {
+		cached := e.Value.(*cachedKeys)
+		if time.Now().Before(cached.expires) {
+			r.lru.MoveToFront(e)
+			r.mu.Unlock()
+			return cached.keys, cached.err
+		}
+	}
+	if f, ok := r.fetching[serverName]; ok {
+		r.mu.Unlock()
+		<-f.done
+		return f.keys, f.err
+	}
+	if len(r.fetching) >= maxKeyFetches {
+		r.mu.Unlock()
+		return nil, errTooManyKeyFetches
+	}
+	if !r.clients.Allow(client, time.Now()) {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("%w from %s", errTooManyKeyFetches, client)
+	}
+	f := &keyFetch{done: make(chan struct{})}
+	r.fetching[serverName] = f
+	r.mu.Unlock()
+
+	keys, expires, err := r.fetch(serverName)
+	if err != nil {
+		expires = time.Now().Add(keyFailureCacheTime)
+	} else if max := time.Now().Add(maxKeyCacheTime); expires.After(max) {
+		expires = max
+	}
+	f.keys, f.err = keys, err
+	r.mu.Lock()
+	delete(r.fetching, serverName)
+	r.store(&cachedKeys{serverName, keys, err, expires})
+	r.mu.Unlock()
+	close(f.done)
+	return keys, err
+}
+
+// store caches keys, evicting the least recently used if the cache is full.
+// r.mu must be held.
+func (r *HTTPKeyResolver) store(cached *cachedKeys) {
+	if e, ok := r.cache[cached.serverName]; ok {
+		e.Value = cached
+		r.lru.MoveToFront(e)
+		return
+	}
+	r.cache[cached.serverName] = r.lru.PushFront(cached)
+	if r.lru.Len() > keyCacheSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.cache, oldest.Value.(*cachedKeys).serverName)
+	}
+}
+
+// get requests the keys of a homeserver from where it is reached over
+// federation, or from URLFormat.
+func (r *HTTPKeyResolver) get(serverName string) (*http.Response, error) {
+	if r.URLFormat != "" {
+		return r.Client.Get(fmt.Sprintf(r.URLFormat, serverName))
+	}
+	server, err := r.Servers.Resolve(serverName)
+	if err != nil {
+		return nil, err
+	}
+	url, ctx := server.URL(context.Background(), "/_matrix/key/v2/server")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r.Client.Do(req)
+}
+
+// fetch fetches the keys of a homeserver, and when they expire.
+func (r *HTTPKeyResolver) fetch(serverName string) (map[string]ed25519.PublicKey, time.Time, error) {
+	resp, err := r.get(serverName)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("key server responded with %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return nil, time.Time{}, err
+	}
+	var parsed struct {
+		ServerName   string `json:"server_name"`
+		ValidUntilTS int64  `json:"valid_until_ts"`
+		VerifyKeys   map[string]struct {
+			Key string `json:"key"`
+		} `json:"verify_keys"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, time.Time{}, err
+	}
+	if parsed.ServerName != serverName {
+		return nil, time.Time{}, fmt.Errorf("key server responded for %q", parsed.ServerName)
+	}
+	keys := make(map[string]ed25519.PublicKey)
+	for keyID, k := range parsed.VerifyKeys {
+		key, err := decodeBase64(k.Key)
+		if err != nil || len(key) != ed25519.PublicKeySize || !strings.HasPrefix(keyID, "ed25519:") {
+			continue
+		}
+		keys[keyID] = ed25519.PublicKey(key)
+	}
+	// the response must be signed by the keys it lists
+	if err := verifyJSON(obj, serverName, keys); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return keys, time.UnixMilli(parsed.ValidUntilTS), nil
+}
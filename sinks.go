@@ -0,0 +1,220 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// ReportEnvelope is how an accepted report is published to sinks. Stats holds
+// every field the homeserver sent, by its name in the report.
+type ReportEnvelope struct {
+	ReceivedAt    int64                  `json:"received_at"` // seconds since epoch
+	Homeserver    string                 `json:"homeserver"`
+	ServerType    string                 `json:"server_type"`
+	ServerVersion string                 `json:"server_version,omitempty"`
+	RemoteAddr    string                 `json:"remote_addr"`
+	Tenant        string                 `json:"tenant,omitempty"` // empty for the default tenant
+	Stats         map[string]interface{} `json:"stats"`
+}
+
+func newReportEnvelope(sr StatsReport, isDendrite bool) *ReportEnvelope {
+	hr := sr.summary(isDendrite)
+	env := &ReportEnvelope{
+		ReceivedAt:    sr.LocalTimestamp,
+		Homeserver:    hr.Homeserver,
+		ServerType:    strings.ToLower(hr.Software),
+		ServerVersion: hr.Version,
+		RemoteAddr:    hr.IP,
+		Stats:         make(map[string]interface{}),
+	}
+	reportedFields(reflect.ValueOf(sr.CommonStats), env.Stats)
+	if isDendrite {
+		reportedFields(reflect.ValueOf(sr.ReportStatsDendrite), env.Stats)
+	} else {
+		reportedFields(reflect.ValueOf(sr.ReportStatsSynapse), env.Stats)
+	}
+	return env
+}
+
+// reportedFields collects the fields of a report struct which have a JSON
+// name and were set by the homeserver.
+func reportedFields(v reflect.Value, out map[string]interface{}) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		f := v.Field(i)
+		if f.Kind() == reflect.Ptr {
+			if f.IsNil() {
+				continue
+			}
+			f = f.Elem()
+		}
+		if f.IsZero() && f.Kind() == reflect.String {
+			continue
+		}
+		out[name] = f.Interface()
+	}
+}
+
+// Sink is somewhere accepted reports are published to.
+type Sink interface {
+	Name() string
+	Publish(env *ReportEnvelope) error
+}
+
+// sinkQueueSize is how many reports may wait for a sink before new ones are
+// dropped.
+const sinkQueueSize = 10000
+
+// SinkQueue publishes reports to a Sink in the background, retrying failures
+// with exponential backoff, so that a failing sink never fails /push.
+type SinkQueue struct {
+	Sink       Sink
+	MaxRetries int
+	queue      chan *ReportEnvelope
+	done       chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewSinkQueue(sink Sink, maxRetries int) *SinkQueue {
+	q := &SinkQueue{
+		Sink:       sink,
+		MaxRetries: maxRetries,
+		queue:      make(chan *ReportEnvelope, sinkQueueSize),
+		done:       make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *SinkQueue) Enqueue(env *ReportEnvelope) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		sinkDropped.WithLabelValues(q.Sink.Name()).Inc()
+		return
+	}
+	select {
+	case q.queue <- env:
+	default:
+		sinkDropped.WithLabelValues(q.Sink.Name()).Inc()
+	}
+}
+
+// Close stops the queue taking reports, and returns once those already queued
+// have been published or dropped, closing the sink if it is an io.Closer.
+func (q *SinkQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	close(q.queue)
+	q.mu.Unlock()
+	<-q.done
+	if c, ok := q.Sink.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func (q *SinkQueue) run() {
+	defer close(q.done)
+	for env := range q.queue {
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			err := q.Sink.Publish(env)
+			if err == nil {
+				sinkPublished.WithLabelValues(q.Sink.Name()).Inc()
+				break
+			}
+			if attempt >= q.MaxRetries {
+				log.Printf("Dropping report from %s after failing to publish it to %s: %v", env.Homeserver, q.Sink.Name(), err)
+				sinkDropped.WithLabelValues(q.Sink.Name()).Inc()
+				break
+			}
+			log.Printf("Error publishing report to %s, retrying in %s: %v", q.Sink.Name(), backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// WebhookSink POSTs each report envelope as JSON to a URL.
+type WebhookSink struct {
+	URL string
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook:" + s.URL
+}
+
+func (s *WebhookSink) Publish(env *ReportEnvelope) error {
+	return postJSON(s.URL, env)
+}
+
+// NATSSink publishes each report envelope as JSON to a NATS subject.
+type NATSSink struct {
+	Conn    *nats.Conn
+	Subject string
+}
+
+func (s *NATSSink) Name() string {
+	return "nats:" + s.Subject
+}
+
+func (s *NATSSink) Close() error {
+	s.Conn.Close()
+	return nil
+}
+
+func (s *NATSSink) Publish(env *ReportEnvelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return s.Conn.Publish(s.Subject, data)
+}
+
+// startEmbeddedNATS runs a NATS server within panopticon, for deployments
+// and tests which do not have one of their own. It returns the URL to
+// connect to.
+func startEmbeddedNATS(port int) (string, error) {
+	ns, err := natsserver.NewServer(&natsserver.Options{
+		Host:   "127.0.0.1",
+		Port:   port,
+		NoLog:  true,
+		NoSigs: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		return "", natsserver.ErrServerNotRunning
+	}
+	return ns.ClientURL(), nil
+}
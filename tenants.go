@@ -0,0 +1,261 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// TenantsConfig lists the independent communities sharing this panopticon.
+// Each tenant's reports are stored in a database of its own, and reports
+// which select no tenant go to the default database, given with --db.
+type TenantsConfig struct {
+	Tenants []TenantConfig `json:"tenants"`
+}
+
+type TenantConfig struct {
+	Name      string   `json:"name"`      // as in /push/{name}
+	Database  string   `json:"database"`  // a MySQL database on the server of --db, or a SQLite file
+	Hostnames []string `json:"hostnames"` // reports sent to these hostnames are for the tenant
+	Tokens    []string `json:"tokens"`    // names of the only auth tokens which may push reports for the tenant
+	Retention struct {
+		Reports Duration `json:"reports"` // 0 for --retain-reports
+		Events  Duration `json:"events"`  // 0 for --retain-events
+	} `json:"retention"`
+	Privacy struct {
+		StoreAddresses *bool `json:"store_addresses"` // nil for --store-addresses
+	} `json:"privacy"`
+}
+
+var tenantNameRegexp = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+var errUnknownTenant = errors.New("unknown tenant")
+
+// A Tenant is where reports for one community are stored.
+type Tenant struct {
+	Name           string // empty for the default tenant
+	DB             *sql.DB
+	StoreAddresses bool
+	Pruner         *Pruner // nil if everything is kept forever
+
+	tokens map[string]bool
+}
+
+// Tenants selects the tenant each report is for.
+type Tenants struct {
+	Default *Tenant
+
+	byName     map[string]*Tenant
+	byHostname map[string]*Tenant
+	byToken    map[string]*Tenant
+}
+
+func loadTenantsConfig(path string) (*TenantsConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &TenantsConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	names := map[string]bool{}
+	for _, t := range cfg.Tenants {
+		if !tenantNameRegexp.MatchString(t.Name) || names[t.Name] {
+			return nil, fmt.Errorf("%s: tenant names must be unique, and only have lowercase letters, digits, - and _: %q", path, t.Name)
+		}
+		names[t.Name] = true
+		if t.Database == "" {
+			return nil, fmt.Errorf("%s: tenant %s needs a database", path, t.Name)
+		}
+		if err := checkReportRetention(t.Retention.Reports.Duration); err != nil {
+			return nil, fmt.Errorf("%s: tenant %s: %w", path, t.Name, err)
+		}
+	}
+	return cfg, nil
+}
+
+// openTenants opens the database of each tenant listed in the file at path,
+// if any, alongside the default tenant using db.
+func openTenants(path string, db *sql.DB) (*Tenants, error) {
+	ts := &Tenants{
+		Default:    &Tenant{DB: db, StoreAddresses: *storeAddresses},
+		byName:     map[string]*Tenant{},
+		byHostname: map[string]*Tenant{},
+		byToken:    map[string]*Tenant{},
+	}
+	if *retainReports > 0 || *retainEvents > 0 {
+		ts.Default.Pruner = &Pruner{DB: db, Reports: *retainReports, Events: *retainEvents}
+	}
+	if path == "" {
+		return ts, nil
+	}
+	cfg, err := loadTenantsConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, tc := range cfg.Tenants {
+		dsn, err := tenantDataSource(tc.Database)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", tc.Name, err)
+		}
+		tdb, err := openDB(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", tc.Name, err)
+		}
+		if err := createTables(tdb); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", tc.Name, err)
+		}
+		t := &Tenant{Name: tc.Name, DB: tdb, StoreAddresses: *storeAddresses, tokens: map[string]bool{}}
+		if tc.Privacy.StoreAddresses != nil {
+			t.StoreAddresses = *tc.Privacy.StoreAddresses
+		}
+		p := &Pruner{DB: tdb, Reports: *retainReports, Events: *retainEvents}
+		if tc.Retention.Reports.Duration > 0 {
+			p.Reports = tc.Retention.Reports.Duration
+		}
+		if tc.Retention.Events.Duration > 0 {
+			p.Events = tc.Retention.Events.Duration
+		}
+		if p.Reports > 0 || p.Events > 0 {
+			t.Pruner = p
+		}
+		ts.byName[t.Name] = t
+		for _, hostname := range tc.Hostnames {
+			ts.byHostname[strings.ToLower(hostname)] = t
+		}
+		for _, name := range tc.Tokens {
+			ts.byToken[name] = t
+			t.tokens[name] = true
+		}
+	}
+	return ts, nil
+}
+
+// tenantDataSource returns the data source of a tenant's database: for MySQL,
+// the database of that name on the server of --db.
+func tenantDataSource(database string) (string, error) {
+	if *dbDriver != "mysql" {
+		return database, nil
+	}
+	cfg, err := mysql.ParseDSN(*dbPath)
+	if err != nil {
+		return "", err
+	}
+	cfg.DBName = database
+	return cfg.FormatDSN(), nil
+}
+
+// tenantConfig returns the configuration of the tenant called name in the
+// tenants file at path.
+func tenantConfig(path, name string) (*TenantConfig, error) {
+	if path == "" {
+		return nil, fmt.Errorf("%w %q: no tenants are configured", errUnknownTenant, name)
+	}
+	cfg, err := loadTenantsConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range cfg.Tenants {
+		if cfg.Tenants[i].Name == name {
+			return &cfg.Tenants[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownTenant, name)
+}
+
+// tenantDatabase returns the data source of the database of the tenant
+// called name in the tenants file at path, or --db for an empty name.
+func tenantDatabase(path, name string) (string, error) {
+	if name == "" {
+		return *dbPath, nil
+	}
+	tc, err := tenantConfig(path, name)
+	if err != nil {
+		return "", err
+	}
+	return tenantDataSource(tc.Database)
+}
+
+// All returns every tenant, starting with the default one.
+func (ts *Tenants) All() []*Tenant {
+	all := []*Tenant{ts.Default}
+	for _, t := range ts.byName {
+		all = append(all, t)
+	}
+	return all
+}
+
+// Lookup returns the tenant with the given name, or the default tenant for
+// an empty name.
+func (ts *Tenants) Lookup(name string) *Tenant {
+	if name == "" {
+		return ts.Default
+	}
+	return ts.byName[name]
+}
+
+// Select returns the tenant a report is for: the one named in its path, as in
+// /push/{tenant}, or else the one its token is for, or else the one whose
+// hostname it was sent to. Tenants with tokens only take reports pushed with
+// one of them.
+func (ts *Tenants) Select(req *http.Request, token *AuthToken) (*Tenant, error) {
+	t := ts.Default
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	if name := strings.TrimPrefix(req.URL.Path, "/push/"); name != req.URL.Path {
+		if t = ts.byName[name]; t == nil {
+			return nil, fmt.Errorf("%w %q", errUnknownTenant, name)
+		}
+	} else if token != nil && ts.byToken[token.Name] != nil {
+		t = ts.byToken[token.Name]
+	} else if ts.byHostname[strings.ToLower(host)] != nil {
+		t = ts.byHostname[strings.ToLower(host)]
+	}
+
+	if token != nil && ts.byToken[token.Name] != nil && ts.byToken[token.Name] != t {
+		return nil, fmt.Errorf("token %s is for tenant %s", token.Name, ts.byToken[token.Name].Name)
+	}
+	if len(t.tokens) > 0 && (token == nil || !t.tokens[token.Name]) {
+		return nil, fmt.Errorf("tenant %s needs one of its tokens", t.Name)
+	}
+	return t, nil
+}
+
+// handler serves the handler made by newHandler for the database of the tenant
+// named by the "tenant" query parameter, or of the default tenant.
+func (ts *Tenants) handler(newHandler func(*sql.DB) http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Query().Get("tenant")
+		t := ts.Lookup(name)
+		if t == nil {
+			logAndReplyError(w, fmt.Errorf("%w %q", errUnknownTenant, name), 404, "Unknown tenant")
+			return
+		}
+		newHandler(t.DB).ServeHTTP(w, req)
+	})
+}
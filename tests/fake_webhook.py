@@ -0,0 +1,21 @@
+#!/usr/bin/env python3
+# Accepts POST requests on the given port and appends each request body as a
+# line to the given file, standing in for a webhook receiver in the tests.
+
+import sys
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+
+class Handler(BaseHTTPRequestHandler):
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers.get("Content-Length", 0)))
+        with open(sys.argv[2], "ab") as f:
+            f.write(body.replace(b"\n", b" ") + b"\n")
+        self.send_response(200)
+        self.end_headers()
+
+    def log_message(self, format, *args):
+        pass
+
+
+HTTPServer(("localhost", int(sys.argv[1])), Handler).serve_forever()
@@ -0,0 +1,28 @@
+#!/usr/bin/env python3
+# Subscribes to a subject on the NATS server at the given port and appends
+# each message payload as a line to the given file. The file is created once
+# the subscription is active.
+
+import socket
+import sys
+
+port, subject, path = int(sys.argv[1]), sys.argv[2], sys.argv[3]
+conn = socket.create_connection(("localhost", port))
+f = conn.makefile("rb")
+f.readline()  # INFO
+conn.sendall(b'CONNECT {"verbose": false}\r\nSUB ' + subject.encode() + b" 1\r\nPING\r\n")
+while not f.readline().startswith(b"PONG"):
+    pass
+open(path, "wb").close()
+
+while True:
+    line = f.readline()
+    if not line:
+        break
+    if line.startswith(b"PING"):
+        conn.sendall(b"PONG\r\n")
+    elif line.startswith(b"MSG"):
+        size = int(line.split()[-1])
+        payload = f.read(size + 2)[:size]
+        with open(path, "ab") as out:
+            out.write(payload + b"\n")
@@ -23,7 +23,7 @@ trap "rm -rf ${dir}" EXIT
 port=9002
 
 cd $(dirname $(dirname $(realpath $0)))
-./panopticon --port=${port} --db=${dir}/stats.db 2>$1 &
+./panopticon --port=${port} --db=${dir}/stats.db ${args:-} 2>$1 &
 PID=$! 
 function kill_server {
   kill $PID
@@ -32,7 +32,7 @@ function kill_server {
 trap kill_server EXIT
 
 log_verbose "Waiting for server to come up"
-until curl -k http://localhost:${port}/healthz >/dev/null 2>/dev/null; do
+until curl -k ${curl_args:-} ${scheme:-http}://localhost:${port}/healthz >/dev/null 2>/dev/null; do
   sleep 0.1
 done
 log_verbose "Server came up"
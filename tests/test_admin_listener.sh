@@ -0,0 +1,48 @@
+#!/bin/bash -eu
+
+socket_dir=$(mktemp -d)
+args="--admin-listen=unix:${socket_dir}/admin.sock --admin-token=letmein"
+. $(dirname $0)/setup.sh
+function cleanup {
+  kill_server
+  rm -rf ${socket_dir}
+}
+trap cleanup EXIT
+log "Testing the public listener"
+
+function status {
+  curl -k -o /dev/null -w '%{http_code}' "$@" 2>/dev/null
+}
+
+until [[ -S ${socket_dir}/admin.sock ]]; do
+  sleep 0.1
+done
+
+assert_eq "200" "$(status -d '{"homeserver": "public.turtles", "total_users": 1}' http://localhost:${port}/push)"
+assert_eq "200" "$(status http://localhost:${port}/healthz)"
+assert_eq "404" "$(status http://localhost:${port}/metrics)"
+assert_eq "404" "$(status http://localhost:${port}/events?homeserver=public.turtles)"
+assert_eq "404" "$(status -X POST -H 'Authorization: Bearer letmein' http://localhost:${port}/admin/reload)"
+
+log "Testing the admin listener"
+admin="--unix-socket ${socket_dir}/admin.sock"
+assert_eq "200" "$(status ${admin} http://admin/healthz)"
+assert_eq "401" "$(status ${admin} http://admin/metrics)"
+assert_eq "401" "$(status ${admin} -H 'Authorization: letmein' http://admin/metrics)"
+assert_eq "200" "$(status ${admin} -H 'Authorization: Bearer letmein' http://admin/metrics)"
+assert_eq "200" "$(status ${admin} -H 'Authorization: Bearer letmein' http://admin/events?homeserver=public.turtles)"
+assert_eq "404" "$(status ${admin} -H 'Authorization: Bearer letmein' -d '{"homeserver": "admin.turtles"}' http://admin/push)"
+assert_eq "200" "$(status ${admin} -X POST -H 'Authorization: Bearer letmein' http://admin/admin/reload)"
+assert_eq "srw-rw----" "$(stat -c %A ${socket_dir}/admin.sock)"
+
+log "Testing that admin endpoints are not public without a token"
+./panopticon --port=9007 --db=${socket_dir}/tokenless.db 2>/dev/null &
+tokenless_pid=$!
+until curl http://localhost:9007/healthz >/dev/null 2>/dev/null; do
+  sleep 0.1
+done
+assert_eq "404" "$(status http://localhost:9007/metrics)"
+assert_eq "404" "$(status http://localhost:9007/events?homeserver=public.turtles)"
+assert_eq "404" "$(status -X POST http://localhost:9007/admin/reload)"
+./panopticon --port=9008 --db=${socket_dir}/tokenless.db --enable-export 2>/dev/null && exit 1
+kill ${tokenless_pid}
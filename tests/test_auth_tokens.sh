@@ -0,0 +1,36 @@
+#!/bin/bash -eu
+
+token_dir=$(mktemp -d)
+cat > ${token_dir}/tokens.json <<CONFIG
+{"tokens": [{"name": "file", "token": "filesecret", "homeservers": ["Bound.Turtles:8448"]}]}
+CONFIG
+
+args="--auth-tokens-file=${token_dir}/tokens.json --auth-tokens-db"
+. $(dirname $0)/setup.sh
+function cleanup {
+  kill_server
+  rm -rf ${token_dir}
+}
+trap cleanup EXIT
+log "Testing bearer token authentication"
+
+function push {
+  curl -k -o /dev/null -w '%{http_code}' "$@" http://localhost:${port}/push 2>/dev/null
+}
+
+assert_eq "401" "$(push -d '{"homeserver": "bound.turtles", "total_users": 1}')"
+assert_eq "401" "$(push -H 'Authorization: Bearer wrong' -d '{"homeserver": "bound.turtles", "total_users": 1}')"
+assert_eq "200" "$(push -H 'Authorization: Bearer filesecret' -d '{"homeserver": "bound.turtles", "total_users": 1}')"
+assert_eq "403" "$(push -H 'Authorization: Bearer filesecret' -d '{"homeserver": "other.turtles", "total_users": 1}')"
+
+log "Testing token management"
+token=$(./panopticon tokens create --db=${dir}/stats.db --name=db)
+assert_eq "200" "$(push -H "Authorization: Bearer ${token}" -d '{"homeserver": "any.turtles", "total_users": 1}')"
+assert_eq "200" "$(push -H "Authorization: Bearer ${token}" -d '{"homeserver": "other.turtles", "total_users": 1}')"
+assert_eq "db|2|other.turtles
+file|1|bound.turtles" "$(sqlite3 ${dir}/stats.db 'SELECT name, use_count, last_homeserver FROM auth_token_usage ORDER BY name')"
+./panopticon tokens list --db=${dir}/stats.db | grep -q "^db .* 2 "
+
+./panopticon tokens revoke --db=${dir}/stats.db --name=db
+assert_eq "401" "$(push -H "Authorization: Bearer ${token}" -d '{"homeserver": "any.turtles", "total_users": 1}')"
+assert_eq "3" "$(sqlite3 ${dir}/stats.db 'SELECT COUNT(*) FROM stats')"
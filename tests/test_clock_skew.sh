@@ -0,0 +1,21 @@
+#!/bin/bash -eu
+
+args="--admin-token=letmein"
+. $(dirname $0)/setup.sh
+log "Testing clock skew measurement"
+
+now=$(date +%s)
+assert_eq "{}" "$(curl -k -d '{"homeserver": "punctual.turtles", "timestamp": '${now}'}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "{}" "$(curl -k -d '{"homeserver": "slow.turtles", "timestamp": '$((now - 3 * 86400))'}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "{}" "$(curl -k -d '{"homeserver": "fast.turtles", "timestamp": '$((now + 3600))'}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "{}" "$(curl -k -d '{"homeserver": "timeless.turtles"}' http://localhost:${port}/push 2>/dev/null)"
+
+assert_eq "fast.turtles|1|future
+punctual.turtles|1|
+slow.turtles|1|past
+timeless.turtles||" "$(sqlite3 ${dir}/stats.db 'SELECT homeserver, abs(clock_skew_seconds - (local_timestamp - remote_timestamp)) < 1, timestamp_flag FROM stats ORDER BY homeserver')"
+
+metrics="$(curl -k -H 'Authorization: Bearer letmein' http://localhost:${port}/metrics 2>/dev/null)"
+assert_eq "panopticon_report_clock_skew_seconds_count 3" "$(grep '^panopticon_report_clock_skew_seconds_count' <<<"${metrics}")"
+assert_eq 'panopticon_suspicious_timestamps_total{action="accept",flag="future"} 1
+panopticon_suspicious_timestamps_total{action="accept",flag="past"} 1' "$(grep '^panopticon_suspicious_timestamps_total' <<<"${metrics}")"
@@ -0,0 +1,12 @@
+#!/bin/bash -eu
+
+args="--suspicious-timestamps=quarantine --max-past-skew=1h"
+. $(dirname $0)/setup.sh
+log "Testing quarantine of reports with suspicious timestamps"
+
+now=$(date +%s)
+assert_eq "{}" "$(curl -k -d '{"homeserver": "punctual.turtles", "timestamp": '$((now - 60))'}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "{}" "$(curl -k -d '{"homeserver": "slow.turtles", "timestamp": '$((now - 7200))'}' http://localhost:${port}/push 2>/dev/null)"
+
+assert_eq "punctual.turtles" "$(sqlite3 ${dir}/stats.db 'SELECT homeserver FROM stats')"
+assert_eq "slow.turtles|timestamp_past|{\"homeserver\": \"slow.turtles\", \"timestamp\": $((now - 7200))}" "$(sqlite3 ${dir}/stats.db 'SELECT homeserver, reason, body FROM quarantine')"
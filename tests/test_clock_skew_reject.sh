@@ -0,0 +1,10 @@
+#!/bin/bash -eu
+
+args="--suspicious-timestamps=reject"
+. $(dirname $0)/setup.sh
+log "Testing rejection of reports with suspicious timestamps"
+
+now=$(date +%s)
+assert_eq '{"error_message": "unable to process request"}' "$(curl -k -d '{"homeserver": "fast.turtles", "timestamp": '$((now + 3600))'}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "{}" "$(curl -k -d '{"homeserver": "punctual.turtles", "timestamp": '${now}'}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "punctual.turtles" "$(sqlite3 ${dir}/stats.db 'SELECT homeserver FROM stats')"
@@ -0,0 +1,51 @@
+#!/bin/bash -eu
+
+config_dir=$(mktemp -d)
+cat > ${config_dir}/panopticon.toml <<CONFIG
+[listeners]
+port = 1
+
+[storage]
+password = "hunter2"
+
+[retention]
+reports = "840h"
+interval = "1s"
+
+[privacy]
+store_addresses = false
+CONFIG
+
+args="--config=${config_dir}/panopticon.toml"
+. $(dirname $0)/setup.sh
+function cleanup {
+  kill_server
+  rm -rf ${config_dir}
+}
+trap cleanup EXIT
+log "Testing the config file"
+
+assert_eq "{}" "$(curl -k -d '{"homeserver": "private.turtles", "total_users": 1}' -H 'X-Forwarded-For: 192.0.2.1' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "private.turtles||" "$(sqlite3 ${dir}/stats.db 'SELECT homeserver, remote_addr, forwarded_for FROM stats')"
+
+sqlite3 ${dir}/stats.db "INSERT INTO stats (homeserver, local_timestamp) VALUES ('old.turtles', 1)"
+sleep 2
+assert_eq "private.turtles" "$(sqlite3 ${dir}/stats.db 'SELECT homeserver FROM stats')"
+
+log "Testing config validation"
+./panopticon config validate --config=${config_dir}/panopticon.toml >/dev/null
+PANOPTICON_RETAIN_REPORTS=24h ./panopticon config validate --config=${config_dir}/panopticon.toml 2>/dev/null && exit 1
+PANOPTICON_OTLP_BATCH_INTERVAL=0s ./panopticon config validate --config=${config_dir}/panopticon.toml 2>/dev/null && exit 1
+PANOPTICON_RETENTION_INTERVAL=0s ./panopticon config validate --config=${config_dir}/panopticon.toml 2>/dev/null && exit 1
+PANOPTICON_ADMIN_LISTEN=:9003 ./panopticon config validate --config=${config_dir}/panopticon.toml 2>/dev/null && exit 1
+PANOPTICON_ADMIN_LISTEN=127.0.0.1:9003 ./panopticon config validate --config=${config_dir}/panopticon.toml >/dev/null
+PANOPTICON_ADMIN_LISTEN=:9003 PANOPTICON_ADMIN_TOKEN=letmein ./panopticon config validate --config=${config_dir}/panopticon.toml >/dev/null
+PANOPTICON_ENABLE_EXPORT=true ./panopticon config validate --config=${config_dir}/panopticon.toml 2>/dev/null && exit 1
+PANOPTICON_ENABLE_EXPORT=true PANOPTICON_ADMIN_TOKEN=letmein ./panopticon config validate --config=${config_dir}/panopticon.toml >/dev/null
+PANOPTICON_RULES_RELOAD_INTERVAL=0s ./panopticon config validate --config=${config_dir}/panopticon.toml 2>/dev/null && exit 1
+echo 'prot = 1' >> ${config_dir}/panopticon.toml
+./panopticon config validate --config=${config_dir}/panopticon.toml 2>/dev/null && exit 1
+
+log "Testing printing the config"
+PANOPTICON_DB_PASSWORD=swordfish ./panopticon config print --config=/dev/null | grep -q '^password = "xxxxx"$'
+PANOPTICON_CONFIG=/dev/null PANOPTICON_PORT=9010 ./panopticon config print | grep -q '^port = 9010$'
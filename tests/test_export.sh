@@ -0,0 +1,30 @@
+#!/bin/bash -eu
+
+args="--enable-export --admin-token=letmein"
+. $(dirname $0)/setup.sh
+log "Testing export of the stats tables"
+
+assert_eq "{}" "$(curl -k -d '{"homeserver": "exported.turtles", "total_users": 12, "cache_factor": 0.5, "timestamp": 1}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "{}" "$(curl -k -H "User-Agent: Dendrite/0.8.3" -d '{"homeserver": "dendrite.turtles", "total_users": 3, "go_os": "linux", "timestamp": 1}' http://localhost:${port}/push 2>/dev/null)"
+
+csv="$(./panopticon export --db=${dir}/stats.db --table=stats --format=csv)"
+assert_eq "server_type,id,homeserver" "$(head -n 1 <<<"${csv}" | cut -d, -f1-3)"
+assert_eq "2" "$(wc -l <<<"${csv}")"
+assert_eq "synapse,1,exported.turtles" "$(tail -n 1 <<<"${csv}" | cut -d, -f1-3)"
+
+jsonl="$(./panopticon export --db=${dir}/stats.db --table=dendrite_stats --format=jsonl)"
+assert_eq '"server_type":"dendrite","id":1,"homeserver":"dendrite.turtles"' "$(cut -c 2-64 <<<"${jsonl}")"
+grep -q '"total_users":3,' <<<"${jsonl}"
+grep -q '"go_os":"linux",' <<<"${jsonl}"
+grep -q '"cpu_average":null,' <<<"${jsonl}"
+
+./panopticon export --db=${dir}/stats.db --table=stats --format=parquet --output=${dir}/stats.parquet
+assert_eq "PAR1" "$(head -c 4 ${dir}/stats.parquet)"
+assert_eq "PAR1" "$(tail -c 4 ${dir}/stats.parquet)"
+
+now=$(date +%s)
+assert_eq "1" "$(./panopticon export --db=${dir}/stats.db --format=jsonl --from=$((now - 60)) | wc -l)"
+assert_eq "0" "$(./panopticon export --db=${dir}/stats.db --format=jsonl --to=2015-01-01 | wc -l)"
+
+assert_eq "${jsonl}" "$(curl -k -H 'Authorization: Bearer letmein' "http://localhost:${port}/export?table=dendrite_stats&format=jsonl" 2>/dev/null)"
+assert_eq '{"error_message": "unable to process request"}' "$(curl -k -H 'Authorization: Bearer letmein' "http://localhost:${port}/export?table=users" 2>/dev/null)"
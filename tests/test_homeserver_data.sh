@@ -0,0 +1,51 @@
+#!/bin/bash -eu
+
+args="--admin-token=letmein"
+. $(dirname $0)/setup.sh
+log "Testing exporting a homeserver's data"
+
+function push {
+  curl -k -o /dev/null -w '%{http_code}' -d "{\"homeserver\": \"$1\", \"total_users\": 1}" http://localhost:${port}/push 2>/dev/null
+}
+
+function rows {
+  python3 -c 'import json, sys; print(" ".join(f"{t}={len(r)}" for t, r in json.load(sys.stdin)["tables"].items() if r))'
+}
+
+assert_eq "200" "$(push erased.turtles)"
+assert_eq "200" "$(push Erased.Turtles)"
+assert_eq "200" "$(push kept.turtles)"
+
+assert_eq "401" "$(curl -k -o /dev/null -w '%{http_code}' "http://localhost:${port}/admin/homeservers/export?homeserver=erased.turtles" 2>/dev/null)"
+exported="$(curl -k -H 'Authorization: Bearer letmein' "http://localhost:${port}/admin/homeservers/export?homeserver=Erased.Turtles" 2>/dev/null)"
+assert_eq "stats=2 homeservers=1 homeserver_networks=1 homeserver_network_days=1" "$(rows <<<"${exported}")"
+assert_eq "stats=2 homeservers=1 homeserver_networks=1 homeserver_network_days=1" "$(./panopticon homeserver-data export --db=${dir}/stats.db --homeserver=erased.turtles | rows)"
+
+log "Testing erasing a homeserver's data"
+assert_eq "405" "$(curl -k -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer letmein' "http://localhost:${port}/admin/homeservers/erase?homeserver=erased.turtles" 2>/dev/null)"
+erased="$(curl -k -X POST -H 'Authorization: Bearer letmein' "http://localhost:${port}/admin/homeservers/erase?homeserver=erased.turtles&recompute=true" 2>/dev/null)"
+assert_eq "2" "$(python3 -c 'import json, sys; print(json.load(sys.stdin)["rows"]["stats"])' <<<"${erased}")"
+assert_eq "0" "$(sqlite3 ${dir}/stats.db "SELECT COUNT(*) FROM stats WHERE homeserver = 'erased.turtles'")"
+assert_eq "0" "$(sqlite3 ${dir}/stats.db "SELECT COUNT(*) FROM homeservers WHERE homeserver = 'erased.turtles'")"
+assert_eq "1" "$(sqlite3 ${dir}/stats.db "SELECT COUNT(*) FROM stats WHERE homeserver = 'kept.turtles'")"
+assert_eq "1" "$(sqlite3 ${dir}/stats.db "SELECT COUNT(*) FROM recompute_requests WHERE completed_at IS NULL")"
+assert_eq "" "$(./panopticon homeserver-data export --db=${dir}/stats.db --homeserver=erased.turtles | rows)"
+
+./panopticon homeserver-data erase --db=${dir}/stats.db --homeserver=kept.turtles >/dev/null
+assert_eq "0" "$(sqlite3 ${dir}/stats.db "SELECT COUNT(*) FROM stats")"
+assert_eq "1" "$(sqlite3 ${dir}/stats.db "SELECT COUNT(*) FROM recompute_requests")"
+
+log "Testing the audit log"
+assert_eq "export|erased.turtles
+export|erased.turtles
+erase|erased.turtles
+export|erased.turtles
+erase|kept.turtles" "$(sqlite3 ${dir}/stats.db 'SELECT action, homeserver FROM audit_log ORDER BY id')"
+assert_eq "http:127.0.0.1" "$(sqlite3 ${dir}/stats.db "SELECT actor FROM audit_log WHERE action = 'erase' ORDER BY id LIMIT 1" | cut -d: -f1-2)"
+assert_eq "cli" "$(sqlite3 ${dir}/stats.db "SELECT actor FROM audit_log ORDER BY id DESC LIMIT 1" | cut -d: -f1)"
+
+log "Testing tables which do not exist"
+assert_eq "200" "$(push partial.turtles)"
+sqlite3 ${dir}/stats.db "DROP TABLE homeserver_network_days"
+exported="$(curl -k -H 'Authorization: Bearer letmein' "http://localhost:${port}/admin/homeservers/export?homeserver=partial.turtles" 2>/dev/null)"
+assert_eq "stats=1 homeservers=1 homeserver_networks=1" "$(rows <<<"${exported}")"
@@ -0,0 +1,43 @@
+#!/bin/bash -eu
+
+args="--admin-token=letmein"
+. $(dirname $0)/setup.sh
+log "Testing homeserver event detection"
+
+function push {
+  assert_eq "{}" "$(curl -k -H "User-Agent: $1" -d "$2" http://localhost:${port}/push 2>/dev/null)"
+}
+
+push "Synapse/1.59.0" '{"homeserver": "eventful.turtles", "uptime_seconds": 100, "database_engine": "Sqlite3", "python_version": "3.9.1"}'
+assert_eq "0" "$(sqlite3 ${dir}/stats.db 'SELECT COUNT(*) FROM homeserver_events')"
+
+push "Synapse/1.59.0" '{"homeserver": "eventful.turtles", "uptime_seconds": 200, "database_engine": "Sqlite3", "python_version": "3.9.1"}'
+assert_eq "0" "$(sqlite3 ${dir}/stats.db 'SELECT COUNT(*) FROM homeserver_events')"
+
+push "Synapse/1.60.0rc1" '{"homeserver": "eventful.turtles", "uptime_seconds": 5, "database_engine": "PostgreSQL", "python_version": "3.10.4"}'
+assert_eq "database_migration|Sqlite3|PostgreSQL
+restart|200|5
+runtime_change|3.9.1|3.10.4
+upgrade|1.59.0|1.60.0rc1" "$(sqlite3 ${dir}/stats.db 'SELECT event_type, old_value, new_value FROM homeserver_events WHERE homeserver == "eventful.turtles" ORDER BY event_type')"
+
+push "Synapse/1.59.0" '{"homeserver": "eventful.turtles"}'
+assert_eq "downgrade|1.60.0rc1|1.59.0" "$(sqlite3 ${dir}/stats.db 'SELECT event_type, old_value, new_value FROM homeserver_events WHERE homeserver == "eventful.turtles" ORDER BY id DESC LIMIT 1')"
+
+events="$(curl -k -H 'Authorization: Bearer letmein' "http://localhost:${port}/events?homeserver=eventful.turtles&type=restart" 2>/dev/null)"
+assert_eq '{"events":[{"homeserver":"eventful.turtles","timestamp":'"$(sqlite3 ${dir}/stats.db 'SELECT timestamp FROM homeserver_events WHERE event_type == "restart"')"',"type":"restart","old_value":"200","new_value":"5"}]}' "${events}"
+assert_eq '{"events":[]}' "$(curl -k -H 'Authorization: Bearer letmein' "http://localhost:${port}/events?homeserver=quiet.turtles" 2>/dev/null)"
+
+# values left out of a report are compared from the last report which had them
+push "Synapse/1.59.0" '{"homeserver": "eventful.turtles", "uptime_seconds": 1, "database_engine": "Sqlite3"}'
+assert_eq "database_migration|PostgreSQL|Sqlite3
+restart|5|1" "$(sqlite3 ${dir}/stats.db 'SELECT event_type, old_value, new_value FROM homeserver_events WHERE homeserver == "eventful.turtles" ORDER BY id DESC LIMIT 2' | sort)"
+
+log "Testing concurrent first reports"
+pids=()
+for i in $(seq 10); do
+  curl -k -o /dev/null -w '%{http_code}\n' -d '{"homeserver": "concurrent.turtles"}' http://localhost:${port}/push >>${dir}/codes 2>/dev/null &
+  pids+=($!)
+done
+wait "${pids[@]}"
+assert_eq "200" "$(sort -u ${dir}/codes)"
+assert_eq "10" "$(sqlite3 ${dir}/stats.db "SELECT report_count FROM homeservers WHERE homeserver = 'concurrent.turtles'")"
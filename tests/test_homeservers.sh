@@ -0,0 +1,15 @@
+#!/bin/bash -eu
+
+. $(dirname $0)/setup.sh
+log "Testing homeserver lifecycle tracking"
+
+assert_eq "{}" "$(curl -k -H "User-Agent: Synapse/1.59.0" -d '{"homeserver": "tracked.turtles", "total_users": 1}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "1|Synapse|1.59.0" "$(sqlite3 ${dir}/stats.db 'SELECT report_count, software, last_version FROM homeservers WHERE homeserver == "tracked.turtles"')"
+
+sleep 1
+assert_eq "{}" "$(curl -k -H "User-Agent: Synapse/1.60.0" -d '{"homeserver": "tracked.turtles", "total_users": 2}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "2|Synapse|1.60.0|1" "$(sqlite3 ${dir}/stats.db 'SELECT report_count, software, last_version, last_seen > first_seen FROM homeservers WHERE homeserver == "tracked.turtles"')"
+assert_eq "1" "$(sqlite3 ${dir}/stats.db 'SELECT COUNT(*) FROM homeservers WHERE homeserver == "tracked.turtles" AND (last_ip == "127.0.0.1" OR last_ip == "::1")')"
+
+assert_eq "{}" "$(curl -k -H "User-Agent: Dendrite/0.8.2" -d '{"homeserver": "dendrite.turtles", "version": "0.8.3"}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "1|Dendrite|0.8.3" "$(sqlite3 ${dir}/stats.db 'SELECT report_count, software, last_version FROM homeservers WHERE homeserver == "dendrite.turtles"')"
@@ -0,0 +1,55 @@
+#!/bin/bash -eu
+
+collector_port=9003
+collector_dir=$(mktemp -d)
+$(dirname $0)/fake_webhook.py ${collector_port} ${collector_dir}/requests &
+collector_pid=$!
+
+cat > ${collector_dir}/tenants.json <<CONFIG
+{"tenants": [{"name": "acme", "database": "${collector_dir}/acme.db"}]}
+CONFIG
+
+args="--otlp-endpoint=http://localhost:${collector_port}/v1/metrics --otlp-batch-interval=100ms --admin-token=letmein --tenants-config=${collector_dir}/tenants.json"
+. $(dirname $0)/setup.sh
+function cleanup {
+  kill_server
+  kill ${collector_pid}
+  rm -rf ${collector_dir}
+}
+trap cleanup EXIT
+log "Testing forwarding of reports to an OTLP collector"
+
+assert_eq "{}" "$(curl -k -H "User-Agent: Synapse/1.60.0" -d '{"homeserver": "otlp.turtles", "total_users": 12, "daily_active_users": 3, "python_version": "3.9.1"}' http://localhost:${port}/push 2>/dev/null)"
+for i in $(seq 50); do
+  if [[ -s ${collector_dir}/requests ]]; then
+    break
+  fi
+  sleep 0.1
+done
+
+local_timestamp=$(sqlite3 ${dir}/stats.db 'SELECT local_timestamp FROM stats WHERE homeserver == "otlp.turtles"')
+assert_eq "matrix.homeserver.name=otlp.turtles matrix.homeserver.type=synapse matrix.homeserver.version=1.60.0
+panopticon
+matrix.homeserver.total_users=12@${local_timestamp}000000000 matrix.homeserver.daily_active_users=3@${local_timestamp}000000000" "$(python3 -c '
+import json, sys
+for rm in json.loads(sys.stdin.readline())["resourceMetrics"]:
+    print(" ".join(a["key"] + "=" + a["value"]["stringValue"] for a in rm["resource"]["attributes"]))
+    for sm in rm["scopeMetrics"]:
+        print(sm["scope"]["name"])
+        print(" ".join(m["name"] + "=" + dp["asInt"] + "@" + dp["timeUnixNano"] for m in sm["metrics"] for dp in m["gauge"]["dataPoints"]))
+' < ${collector_dir}/requests)"
+
+log "Testing that reports to tenants name the tenant"
+assert_eq "{}" "$(curl -k -H "User-Agent: Synapse/1.60.0" -d '{"homeserver": "otlp.turtles", "total_users": 13}' http://localhost:${port}/push/acme 2>/dev/null)"
+for i in $(seq 50); do
+  if [[ "$(wc -l < ${collector_dir}/requests)" == "2" ]]; then
+    break
+  fi
+  sleep 0.1
+done
+assert_eq "matrix.homeserver.name=otlp.turtles matrix.homeserver.type=synapse matrix.homeserver.version=1.60.0 panopticon.tenant=acme" "$(tail -n 1 ${collector_dir}/requests | python3 -c '
+import json, sys
+for rm in json.loads(sys.stdin.readline())["resourceMetrics"]:
+    print(" ".join(a["key"] + "=" + a["value"]["stringValue"] for a in rm["resource"]["attributes"]))
+')"
+assert_eq "panopticon_otlp_exported_reports_total 2" "$(curl -k -H 'Authorization: Bearer letmein' http://localhost:${port}/metrics 2>/dev/null | grep '^panopticon_otlp_exported_reports_total')"
@@ -0,0 +1,63 @@
+#!/bin/bash -eu
+
+wellknown_port=9006
+wellknown_dir=$(mktemp -d)
+echo '{"m.server": "localhost:8448"}' > ${wellknown_dir}/owned.turtles
+echo '{"m.server": "192.0.2.1:8448"}' > ${wellknown_dir}/elsewhere.turtles
+python3 -m http.server ${wellknown_port} --bind 127.0.0.1 --directory ${wellknown_dir} >/dev/null 2>&1 &
+wellknown_pid=$!
+
+args="--wellknown-check-interval=200ms --wellknown-url=http://127.0.0.1:${wellknown_port}/%s --allow-private-targets"
+. $(dirname $0)/setup.sh
+function cleanup {
+  kill_server
+  kill ${wellknown_pid}
+  rm -rf ${wellknown_dir}
+}
+trap cleanup EXIT
+log "Testing ownership verification through .well-known"
+
+assert_eq "{}" "$(curl -k -d '{"homeserver": "owned.turtles", "total_users": 1}' http://127.0.0.1:${port}/push 2>/dev/null)"
+assert_eq "{}" "$(curl -k -d '{"homeserver": "elsewhere.turtles", "total_users": 1}' http://127.0.0.1:${port}/push 2>/dev/null)"
+
+for i in $(seq 50); do
+  if [[ "$(sqlite3 ${dir}/stats.db 'SELECT COUNT(*) FROM homeserver_verifications')" == "2" ]]; then
+    break
+  fi
+  sleep 0.1
+done
+assert_eq "elsewhere.turtles|192.0.2.1:8448|127.0.0.1|0
+owned.turtles|localhost:8448|127.0.0.1|1" "$(sqlite3 ${dir}/stats.db 'SELECT homeserver, delegated_server, reporting_ip, ip_matches FROM homeserver_verifications ORDER BY homeserver')"
+
+log "Testing that homeservers whose address is not stored are not mismatched"
+./panopticon --port=9007 --db=${wellknown_dir}/addressless.db --store-addresses=false ${args} 2>/dev/null &
+addressless_pid=$!
+until curl http://localhost:9007/healthz >/dev/null 2>/dev/null; do
+  sleep 0.1
+done
+assert_eq "{}" "$(curl -k -d '{"homeserver": "elsewhere.turtles", "total_users": 1}' http://127.0.0.1:9007/push 2>/dev/null)"
+for i in $(seq 50); do
+  if [[ "$(sqlite3 ${wellknown_dir}/addressless.db 'SELECT COUNT(*) FROM homeserver_verifications')" == "1" ]]; then
+    break
+  fi
+  sleep 0.1
+done
+kill ${addressless_pid}
+wait ${addressless_pid} || true
+assert_eq "1|1|1" "$(sqlite3 ${wellknown_dir}/addressless.db 'SELECT h.last_ip IS NULL, v.reporting_ip IS NULL, v.ip_matches IS NULL FROM homeservers h JOIN homeserver_verifications v USING (homeserver)')"
+
+log "Testing that .well-known files are not fetched from internal addresses"
+./panopticon --port=9007 --db=${wellknown_dir}/guarded.db --wellknown-check-interval=200ms 2>/dev/null &
+guarded_pid=$!
+until curl http://localhost:9007/healthz >/dev/null 2>/dev/null; do
+  sleep 0.1
+done
+assert_eq "{}" "$(curl -k -d '{"homeserver": "127.0.0.1", "total_users": 1}' http://127.0.0.1:9007/push 2>/dev/null)"
+for i in $(seq 50); do
+  if [[ "$(sqlite3 ${wellknown_dir}/guarded.db 'SELECT COUNT(*) FROM homeserver_verifications')" == "1" ]]; then
+    break
+  fi
+  sleep 0.1
+done
+kill ${guarded_pid}
+sqlite3 ${wellknown_dir}/guarded.db 'SELECT error FROM homeserver_verifications' | grep -q "refusing to connect to internal address 127.0.0.1"
@@ -5,3 +5,4 @@
 log "Testing /push with bad input"
 assert_eq '{"error_message": "unable to process request"}' "$(curl -k -d "not an object" http://localhost:${port}/push 2>/dev/null)"
 assert_eq '{"error_message": "unable to process request"}' "$(curl -k -d "123" http://localhost:${port}/push 2>/dev/null)"
+assert_eq "413" "$(head -c 2000000 /dev/zero | tr '\0' ' ' | curl -k -o /dev/null -w '%{http_code}' --data-binary @- http://localhost:${port}/push 2>/dev/null)"
@@ -0,0 +1,68 @@
+#!/bin/bash -eu
+
+config_dir=$(mktemp -d)
+cat > ${config_dir}/rules.json <<CONFIG
+{"rules": [{"homeserver": "denied.turtles", "action": "reject"}]}
+CONFIG
+cat > ${config_dir}/panopticon.toml <<CONFIG
+[ingestion]
+rules_config = "${config_dir}/rules.json"
+rate_limit = 2
+CONFIG
+
+args="--config=${config_dir}/panopticon.toml --admin-token=letmein"
+. $(dirname $0)/setup.sh
+function cleanup {
+  kill_server
+  rm -rf ${config_dir}
+}
+trap cleanup EXIT
+log "Testing reloading the configuration"
+
+function push {
+  curl -k -o /dev/null -w '%{http_code}' -d "{\"homeserver\": \"$1\", \"total_users\": 1}" http://localhost:${port}/push 2>/dev/null
+}
+
+function reload {
+  curl -k -o /dev/null -w '%{http_code}' -X POST "$@" http://localhost:${port}/admin/reload 2>/dev/null
+}
+
+assert_eq "403" "$(push denied.turtles)"
+assert_eq "200" "$(push busy.turtles)"
+# The limit applies to the client network, whatever homeserver it claims.
+assert_eq "429" "$(push other.turtles)"
+
+log "Testing reloading on SIGHUP"
+cat > ${config_dir}/panopticon.toml <<CONFIG
+[ingestion]
+rate_limit = 5
+CONFIG
+kill -HUP ${PID}
+sleep 0.5
+assert_eq "200" "$(push denied.turtles)"
+assert_eq "200" "$(push busy.turtles)"
+grep -q "Reloaded configuration" $1
+
+log "Testing that invalid configuration is not applied"
+cat > ${config_dir}/panopticon.toml <<CONFIG
+[ingestion]
+rules_config = "${config_dir}/rules.json"
+rate_limit = 2
+
+[logging]
+level = "chatty"
+CONFIG
+assert_eq "401" "$(reload -H 'Authorization: Bearer wrong')"
+assert_eq "400" "$(reload -H 'Authorization: Bearer letmein')"
+assert_eq "200" "$(push denied.turtles)"
+curl -s -H 'Authorization: Bearer letmein' http://localhost:${port}/metrics | grep -q '^panopticon_config_reloads_total{result="failure"} 1$'
+curl -s -H 'Authorization: Bearer letmein' http://localhost:${port}/metrics | grep -q '^panopticon_config_last_reload_successful 0$'
+
+log "Testing reloading through the admin endpoint"
+sed -i 's/chatty/debug/' ${config_dir}/panopticon.toml
+assert_eq "200" "$(reload -H 'Authorization: Bearer letmein')"
+assert_eq "403" "$(push denied.turtles)"
+assert_eq "200" "$(push limited.turtles)"
+assert_eq "429" "$(push limited.turtles)"
+grep -q "Recorded report from limited.turtles" $1
+curl -s -H 'Authorization: Bearer letmein' http://localhost:${port}/metrics | grep -q '^panopticon_config_reloads_total{result="success"} 2$'
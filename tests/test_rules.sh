@@ -0,0 +1,52 @@
+#!/bin/bash -eu
+
+rules_dir=$(mktemp -d)
+cat > ${rules_dir}/rules.json <<CONFIG
+{
+  "rules": [
+    {"homeserver": "localhost", "action": "reject"},
+    {"glob": "*.test", "action": "exclude"},
+    {"regex": "^[0-9.]+(:[0-9]+)?$", "action": "tag", "tag": "ip_literal"},
+    {"network": "127.0.0.0/8", "action": "tag", "tag": "loopback"},
+    {"network": "::1/128", "action": "tag", "tag": "loopback"}
+  ]
+}
+CONFIG
+
+args="--rules-config=${rules_dir}/rules.json --rules-reload-interval=100ms"
+. $(dirname $0)/setup.sh
+function cleanup {
+  kill_server
+  rm -rf ${rules_dir}
+}
+trap cleanup EXIT
+log "Testing rules for homeserver names and networks"
+
+assert_eq "403" "$(curl -k -o /dev/null -w '%{http_code}' -d '{"homeserver": "localhost", "total_users": 1}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "{}" "$(curl -k -d '{"homeserver": "install.test", "total_users": 1}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "{}" "$(curl -k -d '{"homeserver": "10.1.2.3:8008", "total_users": 1}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "install.test|1|
+10.1.2.3:8008||ip_literal,loopback" "$(sqlite3 ${dir}/stats.db 'SELECT homeserver, excluded, tags FROM stats ORDER BY id')"
+
+log "Testing reloading the rules"
+cat > ${rules_dir}/rules.json.new <<CONFIG
+{
+  "default": "reject",
+  "rules": [{"homeserver": "allowed.turtles", "action": "accept"}]
+}
+CONFIG
+mv ${rules_dir}/rules.json.new ${rules_dir}/rules.json
+for i in $(seq 50); do
+  grep -q "Loaded 1 rules" $1 && break
+  sleep 0.1
+done
+assert_eq "403" "$(curl -k -o /dev/null -w '%{http_code}' -d '{"homeserver": "other.turtles", "total_users": 1}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "{}" "$(curl -k -d '{"homeserver": "allowed.turtles", "total_users": 1}' http://localhost:${port}/push 2>/dev/null)"
+
+log "Testing invalid rules are not loaded"
+echo '{"rules": [{"action": "explode"}]}' > ${rules_dir}/rules.json
+for i in $(seq 50); do
+  grep -q "Error reloading rules" $1 && break
+  sleep 0.1
+done
+assert_eq "{}" "$(curl -k -d '{"homeserver": "allowed.turtles", "total_users": 1}' http://localhost:${port}/push 2>/dev/null)"
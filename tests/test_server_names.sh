@@ -0,0 +1,35 @@
+#!/bin/bash -eu
+
+. $(dirname $0)/setup.sh
+log "Testing homeserver name normalization"
+
+assert_eq "{}" "$(curl -k -d '{"homeserver": "Normal.Turtles:8448", "total_users": 1}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "{}" "$(curl -k -d '{"homeserver": "normal.turtles", "total_users": 2}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "{}" "$(curl -k -d '{"homeserver": "schildkröten.turtles:8080", "total_users": 3}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "normal.turtles|Normal.Turtles:8448
+normal.turtles|normal.turtles
+xn--schildkrten-yfb.turtles:8080|schildkröten.turtles:8080" "$(sqlite3 ${dir}/stats.db 'SELECT homeserver, original_homeserver FROM stats ORDER BY id')"
+assert_eq "2" "$(sqlite3 ${dir}/stats.db 'SELECT report_count FROM homeservers WHERE homeserver == "normal.turtles"')"
+
+assert_eq "400" "$(curl -k -o /dev/null -w '%{http_code}' -d '{"homeserver": "bad turtles", "total_users": 1}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "400" "$(curl -k -o /dev/null -w '%{http_code}' -d '{"homeserver": "bad.turtles:99999", "total_users": 1}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "3" "$(sqlite3 ${dir}/stats.db 'SELECT COUNT(*) FROM stats')"
+
+log "Testing renormalization of history"
+sqlite3 ${dir}/stats.db 'INSERT INTO stats (homeserver, local_timestamp) VALUES ("Old.Turtles:443", 100), ("old.turtles", 200)'
+sqlite3 ${dir}/stats.db 'INSERT INTO homeservers (homeserver, first_seen, last_seen, report_count, last_version) VALUES ("Old.Turtles:443", 100, 100, 1, "1.0"), ("old.turtles", 150, 200, 2, "2.0")'
+./panopticon normalize-homeservers --db=${dir}/stats.db
+assert_eq "old.turtles|Old.Turtles:443
+old.turtles|old.turtles" "$(sqlite3 ${dir}/stats.db 'SELECT homeserver, original_homeserver FROM stats WHERE local_timestamp < 1000 ORDER BY id')"
+assert_eq "old.turtles|100|200|3|2.0" "$(sqlite3 ${dir}/stats.db 'SELECT homeserver, first_seen, last_seen, report_count, last_version FROM homeservers WHERE homeserver LIKE "old.turtles%"')"
+
+sqlite3 ${dir}/stats.db 'INSERT INTO homeserver_networks VALUES ("Old.Turtles:443", "192.0.2.0/24", 100, 100, 1), ("old.turtles", "192.0.2.0/24", 150, 200, 2), ("Old.Turtles:443", "198.51.100.0/24", 100, 100, 1)'
+sqlite3 ${dir}/stats.db 'INSERT INTO homeserver_network_days VALUES ("Old.Turtles:443", "192.0.2.0/24", 0, 1), ("old.turtles", "192.0.2.0/24", 0, 2)'
+sqlite3 ${dir}/stats.db 'INSERT INTO homeserver_verifications (homeserver, checked_at, delegated_server) VALUES ("Old.Turtles:443", 300, "new.turtles"), ("old.turtles", 100, "stale.turtles")'
+sqlite3 ${dir}/stats.db 'INSERT INTO auth_token_usage VALUES ("old", 1, 100, "Old.Turtles:443")'
+./panopticon normalize-homeservers --db=${dir}/stats.db
+assert_eq "old.turtles|192.0.2.0/24|100|200|3
+old.turtles|198.51.100.0/24|100|100|1" "$(sqlite3 ${dir}/stats.db 'SELECT * FROM homeserver_networks WHERE homeserver LIKE "old.turtles%" ORDER BY network')"
+assert_eq "old.turtles|192.0.2.0/24|0|3" "$(sqlite3 ${dir}/stats.db 'SELECT * FROM homeserver_network_days WHERE homeserver LIKE "old.turtles%"')"
+assert_eq "old.turtles|300|new.turtles" "$(sqlite3 ${dir}/stats.db 'SELECT homeserver, checked_at, delegated_server FROM homeserver_verifications WHERE homeserver LIKE "old.turtles%"')"
+assert_eq "old.turtles" "$(sqlite3 ${dir}/stats.db 'SELECT last_homeserver FROM auth_token_usage WHERE name = "old"')"
@@ -0,0 +1,55 @@
+#!/bin/bash -eu
+
+key_port=9005
+key_dir=$(mktemp -d)
+cat > ${key_dir}/signed.turtles <<'KEYS'
+{"old_verify_keys":{},"server_name":"signed.turtles","signatures":{"signed.turtles":{"ed25519:test":"8OpXGe+MotjPnTbR0Nx5YDJ90rTpc/YOOtfbmOmFGhCgdXAvYPBjTITauMdS+togm1gVCTgqI06yJHZrZ1evAQ"}},"valid_until_ts":4102444800000,"verify_keys":{"ed25519:test":{"key":"A6EHv/POEL4dcN0Y50vAmWfk1jCbpQ1fHdyGZBJVMbg"}}}
+KEYS
+python3 -m http.server ${key_port} --bind 127.0.0.1 --directory ${key_dir} >/dev/null 2>&1 &
+key_pid=$!
+
+args="--verify-signatures --key-server-url=http://127.0.0.1:${key_port}/%s --allow-private-targets"
+. $(dirname $0)/setup.sh
+function cleanup {
+  kill_server
+  kill ${key_pid}
+  rm -rf ${key_dir}
+}
+trap cleanup EXIT
+log "Testing signed reports"
+
+until curl http://127.0.0.1:${key_port}/signed.turtles >/dev/null 2>/dev/null; do
+  sleep 0.1
+done
+
+signed='{"homeserver":"signed.turtles","signatures":{"signed.turtles":{"ed25519:test":"EMDBjo1+v7n/HqOcBriuJ0hyFdD0nNd/swTclGRlxldtR4++5YiOvIaPTSCbYQaG9PiBSwUGHHUpqxAAQpJHAQ"}},"total_users":1}'
+assert_eq "{}" "$(curl -k -d "${signed}" http://localhost:${port}/push 2>/dev/null)"
+assert_eq "401" "$(curl -k -o /dev/null -w '%{http_code}' -d "${signed/\"total_users\":1/\"total_users\":2}" http://localhost:${port}/push 2>/dev/null)"
+assert_eq "{}" "$(curl -k -d '{"homeserver": "signed.turtles", "total_users": 3}' http://localhost:${port}/push 2>/dev/null)"
+assert_eq "{}" "$(curl -k -d '{"homeserver": "keyless.turtles", "total_users": 4, "signatures": {"keyless.turtles": {"ed25519:x": "AAAA"}}}' http://localhost:${port}/push 2>/dev/null)"
+
+assert_eq "signed.turtles|1|1
+signed.turtles|3|
+keyless.turtles|4|0" "$(sqlite3 ${dir}/stats.db 'SELECT homeserver, total_users, verified FROM stats ORDER BY id')"
+
+log "Testing that keys are not fetched from internal addresses"
+# the fetches each client may cause are counted per minute
+while (( 10#$(date +%S) >= 55 )); do
+  sleep 1
+done
+./panopticon --port=9007 --db=${key_dir}/guarded.db --verify-signatures 2>${key_dir}/guarded.log &
+guarded_pid=$!
+until curl http://localhost:9007/healthz >/dev/null 2>/dev/null; do
+  sleep 0.1
+done
+assert_eq "{}" "$(curl -k -d '{"homeserver": "127.0.0.1:'${key_port}'", "total_users": 5, "signatures": {"127.0.0.1:'${key_port}'": {"ed25519:x": "AAAA"}}}' http://localhost:9007/push 2>/dev/null)"
+
+log "Testing that each client may only cause a few key fetches"
+for i in $(seq 2 11); do
+  curl -k -d '{"homeserver": "127.0.0.'${i}':'${key_port}'", "total_users": 5, "signatures": {"127.0.0.'${i}':'${key_port}'": {"ed25519:x": "AAAA"}}}' http://localhost:9007/push >/dev/null 2>/dev/null
+done
+kill ${guarded_pid}
+assert_eq "0" "$(sqlite3 ${key_dir}/guarded.db 'SELECT DISTINCT verified FROM stats')"
+grep -q "refusing to connect to internal address 127.0.0.1" ${key_dir}/guarded.log
+assert_eq "10" "$(grep -c "refusing to connect to internal address" ${key_dir}/guarded.log)"
+grep -q "too many key fetches from 127.0.0.0/24" ${key_dir}/guarded.log
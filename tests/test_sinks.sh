@@ -0,0 +1,47 @@
+#!/bin/bash -eu
+
+webhook_port=9003
+nats_port=9004
+sink_dir=$(mktemp -d)
+$(dirname $0)/fake_webhook.py ${webhook_port} ${sink_dir}/webhook &
+webhook_pid=$!
+
+args="--sink-webhooks=http://localhost:${webhook_port}/reports,http://localhost:9/unreachable --sink-max-retries=0 --sink-nats-embedded-port=${nats_port} --admin-token=letmein"
+. $(dirname $0)/setup.sh
+$(dirname $0)/nats_subscribe.py ${nats_port} panopticon.reports ${sink_dir}/nats &
+nats_pid=$!
+function cleanup {
+  kill_server
+  kill ${webhook_pid} ${nats_pid}
+  rm -rf ${sink_dir}
+}
+trap cleanup EXIT
+log "Testing publishing of reports to sinks"
+
+until [[ -e ${sink_dir}/nats ]]; do
+  sleep 0.1
+done
+
+assert_eq "{}" "$(curl -k -H "User-Agent: Dendrite/0.8.2" -d '{"homeserver": "published.turtles", "total_users": 12, "go_os": "linux", "monolith": true, "version": "0.8.3"}' http://localhost:${port}/push 2>/dev/null)"
+for i in $(seq 50); do
+  if [[ -s ${sink_dir}/webhook && -s ${sink_dir}/nats ]]; then
+    break
+  fi
+  sleep 0.1
+done
+
+received_at=$(sqlite3 ${dir}/stats.db 'SELECT local_timestamp FROM dendrite_stats WHERE homeserver == "published.turtles"')
+envelope='{"received_at":'${received_at}',"homeserver":"published.turtles","server_type":"dendrite","server_version":"0.8.3","remote_addr":"127.0.0.1","stats":{"go_os":"linux","monolith":true,"total_users":12,"version":"0.8.3"}}'
+assert_eq "${envelope}" "$(cat ${sink_dir}/webhook)"
+assert_eq "${envelope}" "$(cat ${sink_dir}/nats)"
+
+for i in $(seq 50); do
+  if grep -q "Dropping report from published.turtles" $1; then
+    break
+  fi
+  sleep 0.1
+done
+metrics="$(curl -k -H 'Authorization: Bearer letmein' http://localhost:${port}/metrics 2>/dev/null)"
+assert_eq 'panopticon_sink_dropped_reports_total{sink="webhook:http://localhost:9/unreachable"} 1' "$(grep '^panopticon_sink_dropped_reports_total' <<<"${metrics}")"
+assert_eq 'panopticon_sink_published_reports_total{sink="nats:panopticon.reports"} 1
+panopticon_sink_published_reports_total{sink="webhook:http://localhost:9003/reports"} 1' "$(grep '^panopticon_sink_published_reports_total' <<<"${metrics}")"
@@ -0,0 +1,66 @@
+#!/bin/bash -eu
+
+tenant_dir=$(mktemp -d)
+cat > ${tenant_dir}/tenants.json <<CONFIG
+{"tenants": [
+  {"name": "acme", "database": "${tenant_dir}/acme.db", "hostnames": ["stats.acme.test"],
+   "privacy": {"store_addresses": false}},
+  {"name": "beta", "database": "${tenant_dir}/beta.db", "tokens": ["beta"]}
+]}
+CONFIG
+cat > ${tenant_dir}/tokens.json <<CONFIG
+{"tokens": [{"name": "any", "token": "anysecret"}, {"name": "beta", "token": "betasecret"}]}
+CONFIG
+cat > ${tenant_dir}/watch.json <<CONFIG
+{"check_interval": "100ms", "homeservers": [{"name": "path.turtles", "cadence": "1s"}]}
+CONFIG
+
+args="--tenants-config=${tenant_dir}/tenants.json --auth-tokens-file=${tenant_dir}/tokens.json --watch-config=${tenant_dir}/watch.json --admin-token=letmein"
+. $(dirname $0)/setup.sh
+function cleanup {
+  kill_server
+  rm -rf ${tenant_dir}
+}
+trap cleanup EXIT
+log "Testing selecting tenants"
+
+function push {
+  local homeserver=$1 path=$2
+  shift 2
+  curl -k -o /dev/null -w '%{http_code}' -d "{\"homeserver\": \"${homeserver}\", \"total_users\": 1}" "$@" http://localhost:${port}${path} 2>/dev/null
+}
+
+assert_eq "200" "$(push default.turtles /push -H 'Authorization: Bearer anysecret')"
+assert_eq "200" "$(push path.turtles /push/acme -H 'Authorization: Bearer anysecret')"
+assert_eq "200" "$(push host.turtles /push -H 'Authorization: Bearer anysecret' -H 'Host: stats.acme.test:9002')"
+assert_eq "200" "$(push token.turtles /push -H 'Authorization: Bearer betasecret')"
+assert_eq "404" "$(push unknown.turtles /push/gamma -H 'Authorization: Bearer anysecret')"
+assert_eq "403" "$(push token.turtles /push/beta -H 'Authorization: Bearer anysecret')"
+assert_eq "403" "$(push token.turtles /push/acme -H 'Authorization: Bearer betasecret')"
+
+assert_eq "default.turtles|127.0.0.1" "$(sqlite3 ${dir}/stats.db 'SELECT homeserver, remote_addr FROM stats' | cut -d: -f1)"
+assert_eq "path.turtles|
+host.turtles|" "$(sqlite3 ${tenant_dir}/acme.db 'SELECT homeserver, remote_addr FROM stats ORDER BY id')"
+assert_eq "token.turtles" "$(sqlite3 ${tenant_dir}/beta.db 'SELECT homeserver FROM stats')"
+
+log "Testing querying tenants"
+assert_eq "200" "$(curl -k -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer letmein' "http://localhost:${port}/events?homeserver=x&tenant=acme" 2>/dev/null)"
+assert_eq "404" "$(curl -k -o /dev/null -w '%{http_code}' -H 'Authorization: Bearer letmein' "http://localhost:${port}/events?homeserver=x&tenant=gamma" 2>/dev/null)"
+
+log "Testing watching homeservers in tenants"
+sqlite3 ${tenant_dir}/acme.db "UPDATE homeservers SET last_seen = last_seen + 3600 WHERE homeserver = 'path.turtles'"
+sleep 1.5
+grep -q "path.turtles is overdue" $1 && exit 1
+
+log "Testing commands on tenants"
+./panopticon export --db=${dir}/stats.db --tenants-config=${tenant_dir}/tenants.json --tenant=acme --format=jsonl | grep -q '"homeserver":"host.turtles"'
+./panopticon export --db=${dir}/stats.db --tenants-config=${tenant_dir}/tenants.json --tenant=gamma 2>/dev/null && exit 1
+./panopticon normalize-homeservers --db=${dir}/stats.db --tenants-config=${tenant_dir}/tenants.json --tenant=beta
+./panopticon tokens create --db=${dir}/stats.db --tenants-config=${tenant_dir}/tenants.json --tenant=beta --name=other 2>/dev/null && exit 1
+./panopticon tokens create --db=${dir}/stats.db --tenants-config=${tenant_dir}/tenants.json --tenant=beta --name=beta >/dev/null
+./panopticon tokens create --db=${dir}/stats.db --name=other >/dev/null
+./panopticon homeserver-data export --db=${dir}/stats.db --tenants-config=${tenant_dir}/tenants.json --tenant=beta --homeserver=token.turtles | grep -q '"last_homeserver":"token.turtles"'
+./panopticon homeserver-data erase --db=${dir}/stats.db --tenants-config=${tenant_dir}/tenants.json --tenant=beta --homeserver=token.turtles >/dev/null
+assert_eq "0" "$(sqlite3 ${tenant_dir}/beta.db 'SELECT COUNT(*) FROM stats')"
+assert_eq "beta|" "$(sqlite3 ${dir}/stats.db "SELECT name, last_homeserver FROM auth_token_usage WHERE name = 'beta'")"
+assert_eq "beta" "$(./panopticon tokens list --db=${dir}/stats.db --tenants-config=${tenant_dir}/tenants.json --tenant=beta | tail -n +2 | cut -d' ' -f1)"
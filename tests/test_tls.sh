@@ -0,0 +1,38 @@
+#!/bin/bash -eu
+
+tls_dir=$(mktemp -d)
+function make_cert {
+  # make_cert <name> <subject> <issuer>
+  openssl req -newkey rsa:2048 -nodes -keyout ${tls_dir}/$1.key -subj "$2" -addext "subjectAltName=DNS:localhost" -out ${tls_dir}/$1.csr 2>/dev/null
+  openssl x509 -req -in ${tls_dir}/$1.csr -CA ${tls_dir}/$3.crt -CAkey ${tls_dir}/$3.key -CAcreateserial -days 1 -copy_extensions copy -out ${tls_dir}/$1.crt 2>/dev/null
+}
+openssl req -x509 -newkey rsa:2048 -nodes -keyout ${tls_dir}/ca.key -subj "/CN=Turtle CA" -days 1 -out ${tls_dir}/ca.crt 2>/dev/null
+make_cert server "/CN=first" ca
+make_cert client "/O=Turtles/CN=tls.turtles" ca
+
+scheme=https
+curl_args="--cacert ${tls_dir}/ca.crt --cert ${tls_dir}/client.crt --key ${tls_dir}/client.key"
+args="--tls-cert=${tls_dir}/server.crt --tls-key=${tls_dir}/server.key --tls-client-ca=${tls_dir}/ca.crt --tls-reload-interval=0"
+. $(dirname $0)/setup.sh
+function cleanup {
+  kill_server
+  rm -rf ${tls_dir}
+}
+trap cleanup EXIT
+log "Testing TLS with client certificates"
+
+assert_eq "{}" "$(curl ${curl_args} -d '{"homeserver": "tls.turtles", "total_users": 1}' https://localhost:${port}/push 2>/dev/null)"
+assert_eq "CN=tls.turtles,O=Turtles" "$(sqlite3 ${dir}/stats.db 'SELECT client_cert_subject FROM stats')"
+if curl --cacert ${tls_dir}/ca.crt -d '{"homeserver": "tls.turtles"}' https://localhost:${port}/push >/dev/null 2>&1; then
+  log "Push without a client certificate was accepted"
+  exit 1
+fi
+
+log "Testing reloading the certificate on SIGHUP"
+make_cert server "/CN=second" ca
+kill -HUP ${PID}
+for i in $(seq 50); do
+  curl -v ${curl_args} https://localhost:${port}/test 2>&1 | grep -q "subject: CN=second" && break
+  sleep 0.1
+done
+curl -v ${curl_args} https://localhost:${port}/test 2>&1 | grep -q "subject: CN=second"
@@ -0,0 +1,32 @@
+#!/bin/bash -eu
+
+args="--trust-min-reports=2 --trusted-proxies=127.0.1.0/24"
+. $(dirname $0)/setup.sh
+log "Testing trust scores of reports from new networks"
+
+for i in 1 2 3; do
+  assert_eq "{}" "$(curl -k -d '{"homeserver": "trusty.turtles", "total_users": 1}' http://127.0.0.1:${port}/push 2>/dev/null)"
+done
+assert_eq "{}" "$(curl -k --interface 127.0.1.1 -d '{"homeserver": "trusty.turtles", "total_users": 99999}' http://127.0.0.1:${port}/push 2>/dev/null)"
+
+assert_eq "|
+|
+1.0|
+0.0|new_network" "$(sqlite3 ${dir}/stats.db 'SELECT trust_score, tags FROM stats ORDER BY id')"
+assert_eq "127.0.0.0/24|3
+127.0.1.0/24|1" "$(sqlite3 ${dir}/stats.db 'SELECT network, report_count FROM homeserver_networks WHERE homeserver == "trusty.turtles" ORDER BY network')"
+grep -q "Report for trusty.turtles from new network 127.0.1.0/24" $1
+
+log "Testing that only reports within the trust history are counted"
+sqlite3 ${dir}/stats.db "INSERT INTO homeserver_network_days VALUES ('old.turtles', '127.0.0.0/24', 86400, 1000)"
+assert_eq "{}" "$(curl -k -d '{"homeserver": "old.turtles", "total_users": 1}' http://127.0.0.1:${port}/push 2>/dev/null)"
+assert_eq "" "$(sqlite3 ${dir}/stats.db 'SELECT trust_score FROM stats WHERE homeserver == "old.turtles"')"
+assert_eq "1" "$(sqlite3 ${dir}/stats.db 'SELECT SUM(report_count) FROM homeserver_network_days WHERE homeserver == "old.turtles"')"
+
+log "Testing client addresses behind trusted proxies"
+assert_eq "{}" "$(curl -k --interface 127.0.1.1 -H 'X-Forwarded-For: 198.51.100.7, 127.0.1.5' -d '{"homeserver": "proxied.turtles", "total_users": 1}' http://127.0.0.1:${port}/push 2>/dev/null)"
+# only trusted proxies are believed
+assert_eq "{}" "$(curl -k -H 'X-Forwarded-For: 203.0.113.9' -d '{"homeserver": "proxied.turtles", "total_users": 1}' http://127.0.0.1:${port}/push 2>/dev/null)"
+assert_eq "127.0.0.0/24
+198.51.100.0/24" "$(sqlite3 ${dir}/stats.db 'SELECT network FROM homeserver_networks WHERE homeserver == "proxied.turtles" ORDER BY network')"
+assert_eq "127.0.0.1" "$(sqlite3 ${dir}/stats.db 'SELECT last_ip FROM homeservers WHERE homeserver == "proxied.turtles"')"
@@ -0,0 +1,57 @@
+#!/bin/bash -eu
+
+webhook_port=9003
+watch_dir=$(mktemp -d)
+cat > ${watch_dir}/watch.json <<CONFIG
+{
+  "check_interval": "100ms",
+  "webhooks": ["http://localhost:${webhook_port}/alert"],
+  "homeservers": [{"name": "Watched.Turtles:8448", "cadence": "2s"}]
+}
+CONFIG
+$(dirname $0)/fake_webhook.py ${webhook_port} ${watch_dir}/alerts &
+webhook_pid=$!
+
+args="--watch-config=${watch_dir}/watch.json --admin-token=letmein"
+. $(dirname $0)/setup.sh
+function cleanup {
+  kill_server
+  kill ${webhook_pid}
+  rm -rf ${watch_dir}
+}
+trap cleanup EXIT
+log "Testing alerts for watched homeservers"
+
+function wait_for_alerts {
+  for i in $(seq 50); do
+    if [[ "$(cat ${watch_dir}/alerts 2>/dev/null | wc -l)" -ge "$1" ]]; then
+      return
+    fi
+    sleep 0.1
+  done
+}
+
+assert_eq "{}" "$(curl -k -d '{"homeserver": "watched.turtles"}' http://localhost:${port}/push 2>/dev/null)"
+last_seen=$(sqlite3 ${dir}/stats.db 'SELECT last_seen FROM homeservers WHERE homeserver == "watched.turtles"')
+sleep 2
+wait_for_alerts 1
+assert_eq '{"event":"overdue","homeserver":"watched.turtles","last_seen":'${last_seen}',"cadence_seconds":2}' "$(cat ${watch_dir}/alerts)"
+grep -q "Watched homeserver watched.turtles is overdue" $1
+
+assert_eq "{}" "$(curl -k -d '{"homeserver": "watched.turtles"}' http://localhost:${port}/push 2>/dev/null)"
+last_seen=$(sqlite3 ${dir}/stats.db 'SELECT last_seen FROM homeservers WHERE homeserver == "watched.turtles"')
+wait_for_alerts 2
+assert_eq '{"event":"recovered","homeserver":"watched.turtles","last_seen":'${last_seen}',"cadence_seconds":2}' "$(tail -n 1 ${watch_dir}/alerts)"
+assert_eq 'panopticon_watched_homeserver_overdue{homeserver="watched.turtles"} 0' "$(curl -k -H 'Authorization: Bearer letmein' http://localhost:${port}/metrics 2>/dev/null | grep '^panopticon_watched_homeserver_overdue')"
+
+log "Testing unwatching homeservers"
+echo '{"check_interval": "100ms", "homeservers": []}' > ${watch_dir}/watch.json
+kill -HUP ${PID}
+sleep 0.5
+assert_eq "" "$(curl -k -H 'Authorization: Bearer letmein' http://localhost:${port}/metrics 2>/dev/null | grep '^panopticon_watched_homeserver_overdue' || true)"
+
+echo '{"check_interval": "0s", "homeservers": []}' > ${watch_dir}/zero.json
+if ./panopticon --port=9004 --db=${dir}/zero.db --watch-config=${watch_dir}/zero.json 2>/dev/null; then
+  log "A watch config checking every 0s was accepted"
+  exit 1
+fi
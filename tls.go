@@ -0,0 +1,127 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TLSReloader serves a certificate and, optionally, a CA bundle for client
+// certificates from files, reloading them on SIGHUP and when they change.
+type TLSReloader struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string // if set, clients must present a certificate signed by one of these CAs
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// Load reads the certificate, key and CA bundle if any of them has changed.
+// If the new files are invalid, the previous ones are kept.
+func (t *TLSReloader) Load() error {
+	modTimes := make(map[string]time.Time)
+	changed := false
+	for _, path := range []string{t.CertFile, t.KeyFile, t.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[path] = info.ModTime()
+		t.mu.RLock()
+		changed = changed || !info.ModTime().Equal(t.modTimes[path])
+		t.mu.RUnlock()
+	}
+	if !changed {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return err
+	}
+	var clientCA *x509.CertPool
+	if t.ClientCAFile != "" {
+		pem, err := os.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", t.ClientCAFile)
+		}
+	}
+
+	t.mu.Lock()
+	t.cert = &cert
+	t.clientCA = clientCA
+	t.modTimes = modTimes
+	t.mu.Unlock()
+	logInfof("Loaded TLS certificate from %s", t.CertFile)
+	return nil
+}
+
+// Watch reloads the files every interval, unless it is 0, and whenever
+// panopticon receives SIGHUP.
+func (t *TLSReloader) Watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+		}
+		if err := t.Load(); err != nil {
+			log.Printf("Error reloading TLS certificate, keeping the previous one: %v", err)
+		}
+	}
+}
+
+// Config returns a tls.Config which always uses the latest files.
+func (t *TLSReloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*t.cert},
+			}
+			if t.clientCA != nil {
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				cfg.ClientCAs = t.clientCA
+			}
+			return cfg, nil
+		},
+	}
+}
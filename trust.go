@@ -0,0 +1,131 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"net"
+)
+
+// TagNewNetwork is added to the Tags of a report from an established
+// homeserver which was sent from a network it has not reported from before.
+const TagNewNetwork = "new_network"
+
+// Reports are grouped into networks of these sizes, so that a homeserver
+// moving between addresses of its hosting provider is not flagged.
+const (
+	ipv4NetworkBits = 24
+	ipv6NetworkBits = 48
+)
+
+const secondsPerDay = 24 * 60 * 60
+
+func createTableHomeserverNetworks(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS homeserver_networks(
+		homeserver VARCHAR(256) NOT NULL,
+		network VARCHAR(64) NOT NULL,
+		first_seen BIGINT,
+		last_seen BIGINT,
+		report_count BIGINT,
+		PRIMARY KEY (homeserver, network)
+		)`)
+	if err != nil {
+		return err
+	}
+
+	// the reports from each network per day, from which reports are scored
+	// over --trust-history
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS homeserver_network_days(
+		homeserver VARCHAR(256) NOT NULL,
+		network VARCHAR(64) NOT NULL,
+		day BIGINT NOT NULL,
+		report_count BIGINT,
+		PRIMARY KEY (homeserver, network, day)
+		)`)
+	return err
+}
+
+// networkOf returns the network containing an IP address, in CIDR notation,
+// or "" if it is not an IP address.
+func networkOf(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(ipv4NetworkBits, 32)), Mask: net.CIDRMask(ipv4NetworkBits, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(ipv6NetworkBits, 128)), Mask: net.CIDRMask(ipv6NetworkBits, 128)}).String()
+}
+
+// assessTrust scores a report by how much of the recent history of its
+// homeserver came from the same network, from 0 for a network not used
+// recently to 1 for the only network the homeserver reports from. History is
+// counted in whole days, from the start of the day --trust-history ago.
+// Homeservers with fewer than --trust-min-reports reports in that history are
+// not scored. Reports from a new network are tagged with TagNewNetwork. The
+// network is then recorded in the history of the homeserver.
+func assessTrust(db execer, c *CommonStats) error {
+	network := networkOf(c.ClientIP())
+	if network == "" {
+		return nil
+	}
+
+	day := c.LocalTimestamp - c.LocalTimestamp%secondsPerDay
+	since := c.LocalTimestamp - int64(trustHistory.Seconds())
+	since -= since % secondsPerDay
+	var total, fromNetwork int64
+	if err := db.QueryRow(rebind(`SELECT COALESCE(SUM(report_count), 0) FROM homeserver_network_days
+		WHERE homeserver = ? AND day >= ?`), c.Homeserver, since,
+	).Scan(&total); err != nil {
+		return err
+	}
+	if err := db.QueryRow(rebind(`SELECT COALESCE(SUM(report_count), 0) FROM homeserver_network_days
+		WHERE homeserver = ? AND network = ? AND day >= ?`), c.Homeserver, network, since,
+	).Scan(&fromNetwork); err != nil {
+		return err
+	}
+	if total >= int64(*trustMinReports) {
+		score := float64(fromNetwork) / float64(total)
+		c.TrustScore = &score
+		if fromNetwork == 0 {
+			if c.Tags != "" {
+				c.Tags += ","
+			}
+			c.Tags += TagNewNetwork
+			newNetworkReports.Inc()
+			logInfof("Report for %s from new network %s", c.Homeserver, network)
+		}
+	}
+
+	if _, err := db.Exec(rebind(`DELETE FROM homeserver_network_days WHERE homeserver = ? AND day < ?`),
+		c.Homeserver, since,
+	); err != nil {
+		return err
+	}
+	if _, err := db.Exec(rebind(`INSERT INTO homeserver_network_days
+		(homeserver, network, day, report_count) VALUES (?, ?, ?, 1)`+
+		onConflict("homeserver, network, day", "report_count = report_count + 1")),
+		c.Homeserver, network, day,
+	); err != nil {
+		return err
+	}
+	_, err := db.Exec(rebind(`INSERT INTO homeserver_networks
+		(homeserver, network, first_seen, last_seen, report_count) VALUES (?, ?, ?, ?, 1)`+
+		onConflict("homeserver, network", "last_seen = excluded.last_seen, report_count = report_count + 1")),
+		c.Homeserver, network, c.LocalTimestamp, c.LocalTimestamp,
+	)
+	return err
+}
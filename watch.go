@@ -0,0 +1,213 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// WatchConfig lists the homeservers we expect to report on a regular basis,
+// and where to send alerts when they do not.
+type WatchConfig struct {
+	CheckInterval Duration            `json:"check_interval"`
+	Webhooks      []string            `json:"webhooks"`
+	Homeservers   []WatchedHomeserver `json:"homeservers"`
+}
+
+type WatchedHomeserver struct {
+	Name    string   `json:"name"`
+	Cadence Duration `json:"cadence"` // how often the homeserver is expected to report
+}
+
+// WatchAlert is the body of the webhook sent when a watched homeserver becomes
+// overdue or recovers.
+type WatchAlert struct {
+	Event          string `json:"event"` // "overdue" or "recovered"
+	Homeserver     string `json:"homeserver"`
+	LastSeen       int64  `json:"last_seen"` // seconds since epoch, 0 if never seen
+	CadenceSeconds int64  `json:"cadence_seconds"`
+}
+
+func loadWatchConfig(path string) (*WatchConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &WatchConfig{CheckInterval: Duration{time.Minute}}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.CheckInterval.Duration <= 0 {
+		return nil, fmt.Errorf("%s: the check interval must be positive", path)
+	}
+	for i, hs := range cfg.Homeservers {
+		if hs.Name == "" || hs.Cadence.Duration <= 0 {
+			return nil, fmt.Errorf("%s: watched homeservers need a name and a positive cadence", path)
+		}
+		// names are compared with those recorded, which are normalized
+		name, err := normalizeServerName(hs.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		cfg.Homeservers[i].Name = name
+	}
+	return cfg, nil
+}
+
+// watchAlertQueueSize is how many alerts may wait to be sent before new ones
+// are dropped, so that slow webhooks never hold up the checks.
+const watchAlertQueueSize = 100
+
+// queuedAlert is an alert waiting to be sent to the webhooks configured when
+// it was raised.
+type queuedAlert struct {
+	Webhooks []string
+	Alert    WatchAlert
+}
+
+// Watcher periodically checks that every watched homeserver has reported
+// within its cadence, alerting when one becomes overdue and when it recovers.
+// A homeserver's reports count whichever tenant they were sent to.
+type Watcher struct {
+	Tenants *Tenants
+	started time.Time
+	overdue map[string]bool // whether each homeserver was overdue when last checked
+	alerts  chan queuedAlert
+
+	mu     sync.RWMutex
+	config *WatchConfig // nil if no homeservers are watched
+}
+
+// SetConfig replaces the homeservers being watched. Those no longer watched
+// are forgotten at the next check.
+func (w *Watcher) SetConfig(cfg *WatchConfig) {
+	w.mu.Lock()
+	w.config = cfg
+	w.mu.Unlock()
+}
+
+func (w *Watcher) Config() *WatchConfig {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.config
+}
+
+func (w *Watcher) Run() {
+	w.started = time.Now()
+	w.overdue = make(map[string]bool)
+	w.alerts = make(chan queuedAlert, watchAlertQueueSize)
+	go w.sendAlerts()
+	for {
+		interval := time.Minute
+		if cfg := w.Config(); cfg != nil {
+			interval = cfg.CheckInterval.Duration
+		}
+		time.Sleep(interval)
+		w.check(time.Now())
+	}
+}
+
+func (w *Watcher) check(now time.Time) {
+	cfg := w.Config()
+	if cfg == nil {
+		cfg = &WatchConfig{}
+	}
+	watched := make(map[string]bool, len(cfg.Homeservers))
+	for _, hs := range cfg.Homeservers {
+		watched[hs.Name] = true
+	}
+	for name := range w.overdue {
+		if !watched[name] {
+			delete(w.overdue, name)
+			watchedOverdue.DeleteLabelValues(name)
+		}
+	}
+
+	for _, hs := range cfg.Homeservers {
+		lastSeen, err := w.lastSeen(hs.Name)
+		if err != nil {
+			log.Printf("Error checking watched homeserver %s: %v", hs.Name, err)
+			continue
+		}
+
+		// A homeserver we have never heard from gets one cadence's grace from
+		// when we started watching.
+		since := w.started
+		if lastSeen.Valid {
+			since = time.Unix(lastSeen.Int64, 0)
+		}
+		overdue := now.Sub(since) > hs.Cadence.Duration
+		if overdue == w.overdue[hs.Name] {
+			continue
+		}
+		w.overdue[hs.Name] = overdue
+
+		alert := WatchAlert{
+			Event:          "recovered",
+			Homeserver:     hs.Name,
+			LastSeen:       lastSeen.Int64,
+			CadenceSeconds: int64(hs.Cadence.Seconds()),
+		}
+		if overdue {
+			alert.Event = "overdue"
+			watchedOverdue.WithLabelValues(hs.Name).Set(1)
+			log.Printf("Watched homeserver %s is overdue: no report for %s, expected every %s", hs.Name, now.Sub(since).Truncate(time.Second), hs.Cadence)
+		} else {
+			watchedOverdue.WithLabelValues(hs.Name).Set(0)
+			logInfof("Watched homeserver %s has recovered", hs.Name)
+		}
+		if len(cfg.Webhooks) == 0 {
+			continue
+		}
+		select {
+		case w.alerts <- queuedAlert{Webhooks: cfg.Webhooks, Alert: alert}:
+		default:
+			log.Printf("Dropping %s alert for %s: too many alerts waiting to be sent", alert.Event, hs.Name)
+		}
+	}
+}
+
+// sendAlerts posts the queued alerts to their webhooks, in order.
+func (w *Watcher) sendAlerts() {
+	for qa := range w.alerts {
+		for _, url := range qa.Webhooks {
+			if err := postJSON(url, qa.Alert); err != nil {
+				log.Printf("Error sending %s alert for %s: %v", qa.Alert.Event, qa.Alert.Homeserver, err)
+			}
+		}
+	}
+}
+
+// lastSeen returns when the homeserver last reported to any tenant.
+func (w *Watcher) lastSeen(homeserver string) (sql.NullInt64, error) {
+	var latest sql.NullInt64
+	for _, t := range w.Tenants.All() {
+		var lastSeen sql.NullInt64
+		err := t.DB.QueryRow(rebind("SELECT last_seen FROM homeservers WHERE homeserver = ?"), homeserver).Scan(&lastSeen)
+		if err != nil && err != sql.ErrNoRows {
+			return sql.NullInt64{}, fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+		if lastSeen.Valid && (!latest.Valid || lastSeen.Int64 > latest.Int64) {
+			latest = lastSeen
+		}
+	}
+	return latest, nil
+}